@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration file given with -config. Each key sets the default of the flag with
+// the same name, so flags and environment variables override the values in the file.
+type Config struct {
+	Listen        string        `yaml:"listen"`
+	MetricsPath   string        `yaml:"metrics-path"`
+	Interval      time.Duration `yaml:"interval"`
+	Stream        *bool         `yaml:"stream"`
+	Concurrency   int           `yaml:"concurrency"`
+	All           *bool         `yaml:"all"`
+	DockerHosts   []string      `yaml:"docker-hosts"`
+	DockerTimeout time.Duration `yaml:"docker-timeout"`
+	Labels        []string      `yaml:"labels"`
+	Filters       []string      `yaml:"filters"`
+	NameInclude   string        `yaml:"name-include"`
+	NameExclude   string        `yaml:"name-exclude"`
+}
+
+// loadConfig reads and parses the configuration file, rejecting unknown keys.
+func loadConfig(path string) (Config, error) {
+	var config Config
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && !errors.Is(err, io.EOF) {
+		return config, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// apply sets the flags from the configuration, except for those given on the command line or with
+// their environment variable. Must be called after flag.Parse.
+func (c Config) apply() error {
+	type setting struct {
+		flag, env string
+		values    []string
+	}
+	var settings []setting
+	add := func(flag, env string, values ...string) {
+		settings = append(settings, setting{flag, env, values})
+	}
+	if c.Listen != "" {
+		add("listen", "DOCKER_STATS_LISTEN", c.Listen)
+	}
+	if c.MetricsPath != "" {
+		add("metrics-path", "DOCKER_STATS_METRICS_PATH", c.MetricsPath)
+	}
+	if c.Interval != 0 {
+		add("interval", "DOCKER_STATS_INTERVAL", c.Interval.String())
+	}
+	if c.Stream != nil {
+		add("stream", "DOCKER_STATS_STREAM", strconv.FormatBool(*c.Stream))
+	}
+	if c.Concurrency != 0 {
+		add("concurrency", "DOCKER_STATS_CONCURRENCY", strconv.Itoa(c.Concurrency))
+	}
+	if c.All != nil {
+		add("all", "DOCKER_STATS_ALL", strconv.FormatBool(*c.All))
+	}
+	if len(c.DockerHosts) > 0 {
+		add("docker-host", "", c.DockerHosts...)
+	}
+	if c.DockerTimeout != 0 {
+		add("docker-timeout", "DOCKER_STATS_DOCKER_TIMEOUT", c.DockerTimeout.String())
+	}
+	if len(c.Labels) > 0 {
+		add("label", "DOCKER_STATS_LABELS", c.Labels...)
+	}
+	if len(c.Filters) > 0 {
+		add("filter", "DOCKER_STATS_FILTERS", c.Filters...)
+	}
+	if c.NameInclude != "" {
+		add("name-include", "DOCKER_STATS_NAME_INCLUDE", c.NameInclude)
+	}
+	if c.NameExclude != "" {
+		add("name-exclude", "DOCKER_STATS_NAME_EXCLUDE", c.NameExclude)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for _, s := range settings {
+		if _, ok := os.LookupEnv(s.env); explicit[s.flag] || ok {
+			continue
+		}
+		for _, value := range s.values {
+			// Set through the value so that the flag is not seen as given on the command line when
+			// the configuration is reloaded
+			if err := flag.Lookup(s.flag).Value.Set(value); err != nil {
+				return fmt.Errorf("invalid %s in config: %w", s.flag, err)
+			}
+		}
+	}
+	return nil
+}
+
+// reloadConfig resets the flags not given on the command line to their defaults and applies the
+// reloaded configuration file, so that keys removed from the file fall back to the defaults.
+func reloadConfig(config Config) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	flag.VisitAll(func(f *flag.Flag) {
+		if !explicit[f.Name] {
+			setFlag(f, f.DefValue)
+		}
+	})
+	if err := config.apply(); err != nil {
+		return err
+	}
+	return validateFlags()
+}
+
+// flagValues returns the current values of all flags, to be restored with restoreFlags.
+func flagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
+
+// restoreFlags sets all flags back to values returned by flagValues.
+func restoreFlags(values map[string]string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		setFlag(f, values[f.Name])
+	})
+}
+
+// setFlag replaces the value of a flag, including the values of repeatable flags that would
+// otherwise be appended to.
+func setFlag(f *flag.Flag, value string) {
+	if list, ok := f.Value.(*stringList); ok {
+		*list = nil
+	}
+	// The values were valid when they were set, either as the default or the previous value
+	_ = f.Value.Set(value)
+}
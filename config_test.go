@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"empty", "", false},
+		{"valid", "interval: 30s\nlabels: [com.example.team]\n", false},
+		{"unknown key", "intervall: 30s\n", true},
+		{"malformed", "0: [:!00 \xef", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(test.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadConfig(path); (err != nil) != test.wantErr {
+				t.Errorf("loadConfig() error = %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// counterVec is a vector of counters whose values are set directly rather than incremented, for
+// exporting the cumulative counters docker already keeps (cpu time, network bytes, etc.) with the
+// counter metric type.
+type counterVec struct {
+	desc   *prometheus.Desc
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]counterValue
+}
+
+type counterValue struct {
+	labelValues []string
+	value       float64
+}
+
+// counter is a single counter of a counterVec, as returned by counterVec.With.
+type counter struct {
+	vec         *counterVec
+	labelValues []string
+}
+
+func newCounterVec(opts prometheus.CounterOpts, labels []string) *counterVec {
+	return &counterVec{
+		desc:   prometheus.NewDesc(prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name), opts.Help, labels, opts.ConstLabels),
+		labels: labels,
+		values: make(map[string]counterValue),
+	}
+}
+
+func (v *counterVec) labelValues(labels prometheus.Labels) []string {
+	if len(labels) != len(v.labels) {
+		panic("inconsistent label cardinality for " + v.desc.String())
+	}
+	values := make([]string, len(v.labels))
+	for i, name := range v.labels {
+		value, ok := labels[name]
+		if !ok {
+			panic("missing label " + name + " for " + v.desc.String())
+		}
+		values[i] = value
+	}
+	return values
+}
+
+// With returns the counter for the given labels.
+func (v *counterVec) With(labels prometheus.Labels) counter {
+	return counter{vec: v, labelValues: v.labelValues(labels)}
+}
+
+// Delete removes the counter with the given labels, returning whether it existed.
+func (v *counterVec) Delete(labels prometheus.Labels) bool {
+	key := strings.Join(v.labelValues(labels), "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.values[key]
+	delete(v.values, key)
+	return ok
+}
+
+// Set sets the counter to the given value.
+func (c counter) Set(value float64) {
+	key := strings.Join(c.labelValues, "\xff")
+	c.vec.mu.Lock()
+	defer c.vec.mu.Unlock()
+	c.vec.values[key] = counterValue{labelValues: c.labelValues, value: value}
+}
+
+func (v *counterVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *counterVec) Collect(ch chan<- prometheus.Metric) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, value := range v.values {
+		ch <- prometheus.MustNewConstMetric(v.desc, prometheus.CounterValue, value.value, value.labelValues...)
+	}
+}
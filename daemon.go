@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/client"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// daemon is a docker daemon being scraped, along with the series and caches of its containers, so
+// that containers of one daemon are pruned independently of the others.
+type daemon struct {
+	// name is the docker_host label of the series of the daemon
+	name string
+	// host is the -docker-host the daemon was given with, empty for the environment default
+	host string
+	// client is replaced by the scrape loop when the daemon becomes unreachable
+	clientMu sync.Mutex
+	client   dockerClient
+
+	knownContainerIDs       map[string]prometheus.Labels
+	knownContainerStates    map[string]prometheus.Labels
+	knownContainerHealths   map[string]prometheus.Labels
+	knownHealthStatuses     map[string]prometheus.Labels
+	knownContainerCPUs      map[string]prometheus.Labels
+	knownContainerNetworks  map[string]prometheus.Labels
+	knownContainerDiskStats map[string]prometheus.Labels
+	knownContainerInfos     map[string]prometheus.Labels
+	knownContainerMounts    map[string]prometheus.Labels
+	knownNetworkInfos       map[string]prometheus.Labels
+	knownLogInfos           map[string]prometheus.Labels
+	knownCapabilities       map[string]prometheus.Labels
+	knownRestartPolicies    map[string]prometheus.Labels
+	knownGPUs               map[string]prometheus.Labels
+	lastSeenContainers      map[string]lastSeenContainer
+	startTimes              map[string]time.Time
+	knownDaemonInfo         prometheus.Labels
+	// nextContainer is where the next scrape starts taking turns with -max-containers
+	nextContainer int
+	// memTotal is the memory of the docker host, 0 until it has been fetched
+	memTotal int64
+
+	inspectCacheMu sync.Mutex
+	inspectCache   map[string]inspectCacheEntry
+
+	imageCacheMu sync.Mutex
+	imageCache   map[string]imageInfo
+
+	// Values of the -env-label environment variables, by container ID
+	envMu sync.Mutex
+	env   map[string]map[string]string
+
+	// The containers as of the last scrape, for /snapshot
+	snapshotMu sync.Mutex
+	snapshot   []containerSnapshot
+
+	// Labels of the containers with OOM events, by container ID
+	oomEventContainersMu sync.Mutex
+	oomEventContainers   map[string]prometheus.Labels
+
+	// Restart counts of the containers, by their labels
+	restartCounts map[string]*restartCounts
+}
+
+// dockerClient is the part of the docker client used by the exporter, so that a daemon can also be
+// scraped through a fake client.
+type dockerClient interface {
+	ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error)
+	ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error)
+	ContainerStats(ctx context.Context, id string, stream bool) (types.ContainerStats, error)
+	ContainerStatsOneShot(ctx context.Context, id string) (types.ContainerStats, error)
+	ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, []byte, error)
+	Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error)
+	Info(ctx context.Context) (types.Info, error)
+	ServerVersion(ctx context.Context) (types.Version, error)
+	Ping(ctx context.Context) (types.Ping, error)
+	DaemonHost() string
+	Close() error
+}
+
+func newDaemon(host string) (*daemon, error) {
+	docker, err := newDockerClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return newDaemonWithClient(host, docker), nil
+}
+
+// newDaemonWithClient creates a daemon scraped through the given client.
+func newDaemonWithClient(host string, docker dockerClient) *daemon {
+	return &daemon{
+		name:               docker.DaemonHost(),
+		host:               host,
+		lastSeenContainers: make(map[string]lastSeenContainer),
+		inspectCache:       make(map[string]inspectCacheEntry),
+		imageCache:         make(map[string]imageInfo),
+		oomEventContainers: make(map[string]prometheus.Labels),
+		restartCounts:      make(map[string]*restartCounts),
+		env:                make(map[string]map[string]string),
+		client:             docker,
+	}
+}
+
+// docker returns the current client of the daemon.
+func (d *daemon) docker() dockerClient {
+	d.clientMu.Lock()
+	defer d.clientMu.Unlock()
+	return d.client
+}
+
+// newDockerClient creates a docker client from the environment, overridden by the -docker-* flags
+// and the given host.
+func newDockerClient(host string) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if dockerTLSCert != "" || dockerTLSCA != "" {
+		opts = append(opts, client.WithTLSClientConfig(dockerTLSCA, dockerTLSCert, dockerTLSKey))
+	}
+	if strings.HasPrefix(host, "/") {
+		// A bare socket path, such as that of podman
+		host = "unix://" + host
+	}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	if dockerVersion != "" {
+		opts = append(opts, client.WithVersion(dockerVersion))
+	}
+	return client.NewClientWithOpts(opts...)
+}
+
+// connectionFailed returns whether the error means the daemon could not be reached at all, rather
+// than it responding with an error.
+func connectionFailed(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	return client.IsErrConnectionFailed(err) ||
+		errors.Is(err, context.DeadlineExceeded) ||
+		strings.Contains(err.Error(), "error during connect")
+}
+
+// run scrapes the daemon every interval, and whenever trigger receives, until the context is done.
+func (d *daemon) run(ctx context.Context, trigger <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failures := 0
+	backoff := interval
+	var nextReconnect time.Time
+	for {
+		err := d.updateContainers(ctx)
+		d.updateDaemon(ctx)
+		if connectionFailed(ctx, err) {
+			failures++
+		} else {
+			failures = 0
+			backoff = interval
+		}
+		// The client can keep failing after the daemon restarts or its socket is recreated
+		if failures >= reconnectFailures && !time.Now().Before(nextReconnect) {
+			slog.Warn("Recreating docker client", "docker_host", d.name, "failures", failures)
+			if docker, err := newDockerClient(d.host); err != nil {
+				slog.Error("Failed to recreate docker client", "docker_host", d.name, "error", err)
+			} else {
+				d.clientMu.Lock()
+				d.client.Close()
+				d.client = docker
+				d.clientMu.Unlock()
+			}
+			failures = 0
+			nextReconnect = time.Now().Add(backoff)
+			backoff = min(2*backoff, reconnectBackoffMax)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-trigger:
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// watchEvents calls handle for every docker event matching the filter until the context is done.
+// The event stream is resubscribed to after an interval when it fails, e.g. when the daemon restarts.
+func (d *daemon) watchEvents(ctx context.Context, eventFilter filters.Args, handle func(events.Message)) {
+	for ctx.Err() == nil {
+		messages, errs := d.docker().Events(ctx, types.EventsOptions{Filters: eventFilter})
+	stream:
+		for {
+			select {
+			case msg := <-messages:
+				handle(msg)
+			case err := <-errs:
+				if ctx.Err() == nil {
+					scrapeErrors.WithLabelValues(d.name, "events").Inc()
+					logThrottled(slog.LevelError, "Failed to read docker events", err, "docker_host", d.name, "operation", "events")
+				}
+				break stream
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+}
+
+// handleEvent handles a container event, triggering a scrape for container updates with
+// -watch-updates.
+func (d *daemon) handleEvent(msg events.Message, trigger chan<- struct{}) {
+	switch msg.Action {
+	case "oom":
+		d.handleOOMEvent(msg)
+		return
+	case "start", "die":
+		// A container restarting between two scrapes is running in both, so its cached inspect result
+		// would not be refreshed for the new restart count and start time
+		d.forgetInspect(msg.Actor.ID)
+	}
+	if !watchUpdates {
+		return
+	}
+	slog.Debug("Scraping after container event", "docker_host", d.name, "event", msg.Action, "container_id", msg.Actor.ID)
+	select {
+	case trigger <- struct{}{}:
+	default:
+	}
+}
+
+// handleOOMEvent counts an oom event of a container. Only containers listed by a scrape are counted,
+// so that the container filters apply and the counter has the same labels as the other series.
+func (d *daemon) handleOOMEvent(msg events.Message) {
+	// Read the containers seen by the scrapes while none is updating them, a single counter is never
+	// seen half updated by a gather
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	seen, ok := d.lastSeenContainers[msg.Actor.ID]
+	if !ok {
+		slog.Debug("Ignoring OOM event of a container not listed", "docker_host", d.name, "container_id", msg.Actor.ID)
+		return
+	}
+	d.oomEventContainersMu.Lock()
+	d.oomEventContainers[msg.Actor.ID] = seen.labels
+	d.oomEventContainersMu.Unlock()
+	oomEvents.With(seen.labels).Inc()
+}
+
+// pruneOOMEvents removes the OOM event counters of containers that are no longer seen.
+func (d *daemon) pruneOOMEvents() {
+	d.oomEventContainersMu.Lock()
+	defer d.oomEventContainersMu.Unlock()
+	for id, labels := range d.oomEventContainers {
+		if _, ok := d.lastSeenContainers[id]; !ok {
+			oomEvents.Delete(labels)
+			delete(d.oomEventContainers, id)
+		}
+	}
+}
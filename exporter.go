@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// defaultDockerSocket is where the docker client connects to without DOCKER_HOST.
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// exporter scrapes the docker daemons into its registry until it is stopped. It is replaced by a new
+// one when the configuration is reloaded, since the labels of the metrics can change.
+type exporter struct {
+	registry *prometheus.Registry
+	daemons  []*daemon
+	cancel   context.CancelFunc
+	scrapes  sync.WaitGroup
+	// When the exporter started, as the start time of its cumulative metrics
+	started time.Time
+	// The -docker-timeout of the exporter, as the flags are rewritten while reloading
+	dockerTimeout time.Duration
+}
+
+// metricsMu is held for writing while a scrape updates and prunes the series of its containers, so
+// that the metrics are never gathered with a scrape half applied.
+var metricsMu sync.RWMutex
+
+// consistentGatherer gathers a registry while no scrape is updating it.
+type consistentGatherer struct {
+	registry *prometheus.Registry
+}
+
+func (g consistentGatherer) Gather() ([]*dto.MetricFamily, error) {
+	metricsMu.RLock()
+	defer metricsMu.RUnlock()
+	return g.registry.Gather()
+}
+
+// gatherer returns the gatherer of the metrics of the exporter.
+func (e *exporter) gatherer() prometheus.Gatherer {
+	return consistentGatherer{e.registry}
+}
+
+// newDaemons creates the daemons of the -docker-host flags, or of DOCKER_HOST when none are given.
+func newDaemons() ([]*daemon, error) {
+	hosts := dockerHosts
+	if len(hosts) == 0 {
+		// DOCKER_HOST or the default socket
+		hosts = []string{defaultDockerHost()}
+	}
+	var daemons []*daemon
+	names := make(map[string]bool)
+	for _, host := range hosts {
+		d, err := newDaemon(host)
+		if err != nil {
+			closeDaemons(daemons)
+			return nil, fmt.Errorf("creating docker client for %q: %w", host, err)
+		}
+		if names[d.name] {
+			closeDaemons(append(daemons, d))
+			return nil, fmt.Errorf("docker host %q given more than once", d.name)
+		}
+		names[d.name] = true
+		daemons = append(daemons, d)
+	}
+	return daemons, nil
+}
+
+// defaultDockerHost returns the socket of rootless docker or of podman when DOCKER_HOST is not set
+// and the default docker socket does not exist, or an empty string to leave it to the docker client.
+func defaultDockerHost() string {
+	if os.Getenv("DOCKER_HOST") != "" {
+		return ""
+	}
+	if _, err := os.Stat(defaultDockerSocket); err == nil {
+		return ""
+	}
+	var sockets []string
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "docker.sock"), filepath.Join(dir, "podman", "podman.sock"))
+	}
+	sockets = append(sockets, "/run/podman/podman.sock")
+	for _, socket := range sockets {
+		if _, err := os.Stat(socket); err == nil {
+			slog.Info("Using docker socket", "socket", socket)
+			return "unix://" + socket
+		}
+	}
+	return ""
+}
+
+func closeDaemons(daemons []*daemon) {
+	for _, d := range daemons {
+		d.docker().Close()
+	}
+}
+
+// startExporter sets up the metrics and starts scraping the daemons.
+func startExporter(ctx context.Context, daemons []*daemon) *exporter {
+	setup()
+	e := &exporter{registry: registry, daemons: daemons, started: time.Now(), dockerTimeout: dockerTimeout}
+	ctx, e.cancel = context.WithCancel(ctx)
+	for _, d := range daemons {
+		d := d
+		// Scrapes triggered by events are coalesced while a scrape is in progress
+		trigger := make(chan struct{}, 1)
+		eventFilter := filters.NewArgs(filters.Arg("type", "container"), filters.Arg("event", "oom"),
+			filters.Arg("event", "start"), filters.Arg("event", "die"))
+		if watchUpdates {
+			eventFilter.Add("event", "destroy")
+		}
+		e.scrapes.Add(2)
+		go func() {
+			defer e.scrapes.Done()
+			d.watchEvents(ctx, eventFilter, func(msg events.Message) {
+				d.handleEvent(msg, trigger)
+			})
+		}()
+		go func() {
+			defer e.scrapes.Done()
+			d.run(ctx, trigger)
+		}()
+	}
+	if output == "graphite" {
+		e.scrapes.Add(1)
+		go func() {
+			defer e.scrapes.Done()
+			pushGraphite(ctx, graphiteAddr, e.gatherer())
+		}()
+	}
+	if output == "otlp" {
+		e.scrapes.Add(1)
+		go func() {
+			defer e.scrapes.Done()
+			pushOTLP(ctx, otlpEndpoint, e.gatherer(), e.started)
+		}()
+	}
+	if basepath != "" {
+		e.scrapes.Add(1)
+		go func() {
+			defer e.scrapes.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				updateData(basepath)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+	return e
+}
+
+// stop stops scraping and closes the docker clients once the scrapes in progress are done.
+func (e *exporter) stop() {
+	e.cancel()
+	e.scrapes.Wait()
+	closeDaemons(e.daemons)
+}
+
+// reload stops the exporter and starts a new one with the configuration file reloaded. The previous
+// configuration is kept when the new one is invalid, and the exporter keeps running when the file
+// cannot even be parsed. Otherwise the series of the previous exporter are dropped, so counters kept
+// by the exporter itself such as the OOM events start over.
+func (e *exporter) reload(ctx context.Context) *exporter {
+	config, err := loadConfig(configPath)
+	if err != nil {
+		slog.Error("Failed to reload config, keeping the previous one", "config", configPath, "error", err)
+		return e
+	}
+	e.stop()
+	previous := flagValues()
+	err = reloadConfig(config)
+	var daemons []*daemon
+	if err == nil {
+		daemons, err = newDaemons()
+	}
+	if err != nil {
+		slog.Error("Failed to reload config, keeping the previous one", "config", configPath, "error", err)
+		restoreFlags(previous)
+		if err := validateFlags(); err != nil {
+			fatal("Invalid configuration", "error", err)
+		}
+		if daemons, err = newDaemons(); err != nil {
+			fatal("Failed to create docker clients", "error", err)
+		}
+	} else {
+		slog.Info("Reloaded config", "config", configPath)
+	}
+	return startExporter(ctx, daemons)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/errdefs"
+)
+
+const fakeDockerHost = "unix:///fake/docker.sock"
+
+func TestMain(m *testing.M) {
+	parseFlags()
+	os.Exit(m.Run())
+}
+
+// fakeDocker is a docker client serving canned containers, inspect results and stats.
+type fakeDocker struct {
+	mu         sync.Mutex
+	containers []types.Container
+	hidden     map[string]bool
+	inspects   map[string]types.ContainerJSON
+	stats      map[string]types.StatsJSON
+	statsCalls map[string]int
+}
+
+func newFakeDocker() *fakeDocker {
+	return &fakeDocker{
+		hidden:     make(map[string]bool),
+		inspects:   make(map[string]types.ContainerJSON),
+		stats:      make(map[string]types.StatsJSON),
+		statsCalls: make(map[string]int),
+	}
+}
+
+// add adds a container to the fake with the given state and stats. Getting the stats of a container
+// added without them fails with a timeout, like for a daemon that is slow to respond.
+func (f *fakeDocker) add(id, name, state string, stats *types.StatsJSON) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.containers = append(f.containers, types.Container{
+		ID:      id,
+		Names:   []string{"/" + name},
+		Image:   "nginx:latest",
+		ImageID: "sha256:" + id,
+		State:   state,
+	})
+	f.inspects[id] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + name,
+			Created:    "2024-01-01T00:00:00Z",
+			State:      &types.ContainerState{Status: state, Running: state == "running", StartedAt: "2024-01-02T00:00:00Z"},
+			HostConfig: &container.HostConfig{},
+		},
+		Config: &container.Config{},
+	}
+	if stats != nil {
+		f.stats[id] = *stats
+	}
+}
+
+// set lists only the containers with the given IDs.
+func (f *fakeDocker) set(ids ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.containers {
+		f.hidden[c.ID] = !slices.Contains(ids, c.ID)
+	}
+}
+
+// rename renames a container, like docker rename.
+func (f *fakeDocker) rename(id, name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.containers {
+		if f.containers[i].ID == id {
+			f.containers[i].Names = []string{"/" + name}
+		}
+	}
+	f.inspects[id].ContainerJSONBase.Name = "/" + name
+}
+
+// restart sets the restart count of a container.
+func (f *fakeDocker) restart(id string, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inspects[id].ContainerJSONBase.RestartCount = count
+}
+
+func (f *fakeDocker) calls(id string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.statsCalls[id]
+}
+
+func (f *fakeDocker) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var containers []types.Container
+	for _, c := range f.containers {
+		if !f.hidden[c.ID] && (options.All || c.State == "running") {
+			containers = append(containers, c)
+		}
+	}
+	return containers, nil
+}
+
+func (f *fakeDocker) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inspect, ok := f.inspects[id]
+	if !ok {
+		return inspect, errdefs.NotFound(errors.New("no such container: " + id))
+	}
+	// Copied, so that later changes to the container do not show in earlier results
+	base := *inspect.ContainerJSONBase
+	inspect.ContainerJSONBase = &base
+	return inspect, nil
+}
+
+func (f *fakeDocker) ContainerStats(ctx context.Context, id string, stream bool) (types.ContainerStats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.statsCalls[id]++
+	stats, ok := f.stats[id]
+	if !ok {
+		return types.ContainerStats{}, context.DeadlineExceeded
+	}
+	var body bytes.Buffer
+	frames := 1
+	if stream {
+		frames = 2
+	}
+	for i := 0; i < frames; i++ {
+		json.NewEncoder(&body).Encode(stats)
+	}
+	return types.ContainerStats{Body: io.NopCloser(&body)}, nil
+}
+
+func (f *fakeDocker) ContainerStatsOneShot(ctx context.Context, id string) (types.ContainerStats, error) {
+	return f.ContainerStats(ctx, id, false)
+}
+
+func (f *fakeDocker) ImageInspectWithRaw(ctx context.Context, id string) (types.ImageInspect, []byte, error) {
+	return types.ImageInspect{ID: id, Created: "2023-06-01T00:00:00Z"}, nil, nil
+}
+
+func (f *fakeDocker) Events(ctx context.Context, options types.EventsOptions) (<-chan events.Message, <-chan error) {
+	return make(chan events.Message), make(chan error)
+}
+
+func (f *fakeDocker) Info(ctx context.Context) (types.Info, error) {
+	return types.Info{MemTotal: 8 << 30}, nil
+}
+
+func (f *fakeDocker) ServerVersion(ctx context.Context) (types.Version, error) {
+	return types.Version{Version: "24.0.0", APIVersion: "1.43"}, nil
+}
+
+func (f *fakeDocker) Ping(ctx context.Context) (types.Ping, error) {
+	return types.Ping{APIVersion: "1.43"}, nil
+}
+
+func (f *fakeDocker) DaemonHost() string {
+	return fakeDockerHost
+}
+
+func (f *fakeDocker) Close() error {
+	return nil
+}
+
+// fakeStats returns stats of a running container with the given per CPU usage, one per online CPU.
+func fakeStats(perCPU ...uint64) *types.StatsJSON {
+	var stats types.StatsJSON
+	stats.Read = time.Now()
+	stats.CPUStats.CPUUsage.PercpuUsage = perCPU
+	for _, usage := range perCPU {
+		stats.CPUStats.CPUUsage.TotalUsage += usage
+	}
+	stats.CPUStats.CPUUsage.UsageInUsermode = stats.CPUStats.CPUUsage.TotalUsage / 2
+	stats.CPUStats.OnlineCPUs = uint32(len(perCPU))
+	stats.CPUStats.SystemUsage = 100e9
+	stats.PidsStats.Current = 5
+	stats.MemoryStats.Usage = 50e6
+	stats.MemoryStats.Failcnt = 3
+	stats.MemoryStats.Stats = map[string]uint64{"inactive_file": 5e6, "anon": 40e6, "file": 10e6}
+	return &stats
+}
+
+// withFlag sets a flag variable for the duration of a test.
+func withFlag[T any](t testing.TB, variable *T, value T) {
+	t.Helper()
+	previous := *variable
+	*variable = value
+	t.Cleanup(func() { *variable = previous })
+}
+
+// newTestDaemon sets up new metrics and returns a daemon scraping the fake.
+func newTestDaemon(t testing.TB, docker *fakeDocker) *daemon {
+	t.Helper()
+	withFlag(t, &inspectCacheTTL, 0)
+	setup()
+	return newDaemonWithClient(fakeDockerHost, docker)
+}
+
+// scrape scrapes the containers of a daemon once.
+func scrape(t testing.TB, d *daemon) {
+	t.Helper()
+	if err := d.updateContainers(context.Background()); err != nil {
+		t.Fatalf("scrape failed: %v", err)
+	}
+}
+
+// series are the values of the series of a metric, by the value of one of their labels.
+type series map[string]float64
+
+// gather returns the series of a metric by the given label, histograms by their sample count.
+func gather(t *testing.T, name, label string) series {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gathering metrics failed: %v", err)
+	}
+	result := make(series)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := ""
+			for _, l := range metric.GetLabel() {
+				if l.GetName() == label {
+					key = l.GetValue()
+				}
+			}
+			switch {
+			case metric.Gauge != nil:
+				result[key] = metric.Gauge.GetValue()
+			case metric.Counter != nil:
+				result[key] = metric.Counter.GetValue()
+			case metric.Histogram != nil:
+				result[key] = float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	return result
+}
+
+func TestUpdateContainers(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(2e9, 2e9))
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+
+	if got := gather(t, "container_cpu_usage_seconds_total", "container_name"); got["web"] != 4 {
+		t.Errorf("container_cpu_usage_seconds_total = %v, want web at 4", got)
+	}
+	if got := gather(t, "container_memory_usage_bytes", "container_name"); got["web"] != 45e6 {
+		t.Errorf("container_memory_usage_bytes = %v, want web at 45e6", got)
+	}
+	if got := gather(t, "container_pids", "container_name"); got["web"] != 5 {
+		t.Errorf("container_pids = %v, want web at 5", got)
+	}
+	if got := gather(t, "docker_containers_running", "docker_host"); got[fakeDockerHost] != 1 {
+		t.Errorf("docker_containers_running = %v, want 1", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How long connecting to graphite and writing the metrics of a push may take
+const graphiteTimeout = 10 * time.Second
+
+// graphiteTagReplacer replaces the characters that are not allowed in graphite tag values, or that
+// would break the plaintext protocol.
+var graphiteTagReplacer = strings.NewReplacer(" ", "_", ";", "_", "~", "_", "\n", "_")
+
+// pushGraphite writes the metrics of the registry to the graphite plaintext listener at addr every
+// interval until the context is done.
+func pushGraphite(ctx context.Context, addr string, gatherer prometheus.Gatherer) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := writeGraphite(ctx, addr, gatherer, time.Now()); err != nil {
+			logThrottled(slog.LevelError, "Failed to push metrics to graphite", err, "address", addr)
+		}
+	}
+}
+
+// writeGraphite connects to graphite and writes the metrics of the registry to it.
+func writeGraphite(ctx context.Context, addr string, gatherer prometheus.Gatherer, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, graphiteTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	w := bufio.NewWriter(conn)
+	if err := formatGraphite(w, gatherer, now); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// formatGraphite writes the metrics of the registry in the graphite plaintext format, with the labels
+// as graphite tags. Labels with empty values are left out, as graphite does not allow empty tags.
+func formatGraphite(w io.Writer, gatherer prometheus.Gatherer, now time.Time) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			tags := ""
+			for _, label := range metric.GetLabel() {
+				if label.GetValue() != "" {
+					tags += ";" + label.GetName() + "=" + graphiteTagReplacer.Replace(label.GetValue())
+				}
+			}
+			write := func(name, tags string, value float64) error {
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					return nil
+				}
+				_, err := fmt.Fprintf(w, "%s%s %s %s\n", name, tags, strconv.FormatFloat(value, 'g', -1, 64), timestamp)
+				return err
+			}
+			name := family.GetName()
+			switch {
+			case metric.Gauge != nil:
+				err = write(name, tags, metric.Gauge.GetValue())
+			case metric.Counter != nil:
+				err = write(name, tags, metric.Counter.GetValue())
+			case metric.Untyped != nil:
+				err = write(name, tags, metric.Untyped.GetValue())
+			case metric.Histogram != nil:
+				for _, bucket := range metric.Histogram.GetBucket() {
+					le := strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)
+					if err = write(name+"_bucket", tags+";le="+le, float64(bucket.GetCumulativeCount())); err != nil {
+						return err
+					}
+				}
+				if err = write(name+"_count", tags, float64(metric.Histogram.GetSampleCount())); err == nil {
+					err = write(name+"_sum", tags, metric.Histogram.GetSampleSum())
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
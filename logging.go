@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logThrottle is the minimum time between logging identical errors
+const logThrottle = time.Minute
+
+type throttledLog struct {
+	last       time.Time
+	suppressed int
+}
+
+var (
+	throttledLogsMu sync.Mutex
+	throttledLogs   = make(map[string]*throttledLog)
+)
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// setupLogging configures the default logger according to the -log-format and -log-level flags.
+func setupLogging(format, level string) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		fatal("Invalid log level", "level", level, "error", err)
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, opts)))
+	default:
+		fatal("Invalid log format, expected text or json", "format", format)
+	}
+}
+
+// logThrottled logs an error at most once per logThrottle for each distinct message and error, so that
+// an unreachable daemon doesn't flood the logs. The number of suppressed identical errors is included
+// when the error is logged again.
+func logThrottled(level slog.Level, msg string, err error, args ...any) {
+	key := msg + "\x00" + err.Error()
+	now := time.Now()
+
+	throttledLogsMu.Lock()
+	entry := throttledLogs[key]
+	if entry != nil && now.Sub(entry.last) < logThrottle {
+		entry.suppressed++
+		throttledLogsMu.Unlock()
+		return
+	}
+	suppressed := 0
+	if entry != nil {
+		suppressed = entry.suppressed
+	}
+	for k, e := range throttledLogs {
+		if e.suppressed == 0 && now.Sub(e.last) >= logThrottle {
+			delete(throttledLogs, k)
+		}
+	}
+	throttledLogs[key] = &throttledLog{last: now}
+	throttledLogsMu.Unlock()
+
+	args = append(args, "error", err)
+	if suppressed > 0 {
+		args = append(args, "suppressed", suppressed)
+	}
+	slog.Log(context.Background(), level, msg, args...)
+}
@@ -1,91 +1,600 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/json"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/client"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
 )
 
 const (
-	containerPrefix = "container_"
-	dataPrefix      = "container_data_"
+	exporterPrefix = "docker_stats_"
+	dockerPrefix   = "docker_"
+
+	landingPage = `<html>
+<head><title>Docker Stats Exporter</title></head>
+<body>
+<h1>Docker Stats Exporter</h1>
+<p><a href="%[1]s">Metrics</a></p>
+</body>
+</html>
+`
+
+	// How long the last seen timestamp of a container is kept after it disappears
+	lastSeenRetention = 5 * time.Minute
+
+	// Memory limits at or above this are reported for containers without a limit
+	unlimitedMemory = 1 << 62
+
+	// Consecutive scrapes failing to connect to the daemon after which the docker client is recreated,
+	// and the maximum time between recreating it while the daemon stays unreachable
+	reconnectFailures   = 3
+	reconnectBackoffMax = 5 * time.Minute
 )
 
+// Set at build time with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// allInfoLabels are the labels of container_info besides the container labels, -info-labels selects
+// a subset of them.
+var allInfoLabels = []string{
+	"container_id",
+	"container_image_id",
+	"container_image_name",
+	"container_image_digest",
+	"container_state",
+	"container_state_running",
+	"container_state_paused",
+	"container_state_restarting",
+	"container_state_oomkilled",
+	"container_state_dead",
+	"container_network_mode",
+	"container_user",
+}
+
+// allMetricGroups are the groups of container metrics, -metrics selects a subset of them.
+var allMetricGroups = []string{
+	"cpu",
+	"memory",
+	"pids",
+	"network",
+	"blkio",
+	"info",
+	"state",
+	"health",
+	"mounts",
+	"log",
+	"privileges",
+	"restart",
+	"devices",
+}
+
+// containerStates are the values of the state label of container_state.
+var containerStates = []string{"created", "running", "paused", "restarting", "removing", "exited", "dead"}
+
 var (
-	knownContainerIDs       map[string]prometheus.Labels
-	knownContainerNetworks  map[string]prometheus.Labels
-	knownContainerDiskStats map[string]prometheus.Labels
-	knownContainerInfos     map[string]prometheus.Labels
-	knownDataNames          map[string]prometheus.Labels
+	containerPrefix string
+
+	interval            time.Duration
+	stream              bool
+	listen              string
+	all                 bool
+	listSize            bool
+	extraLabels         stringList
+	envLabels           stringList
+	listFilters         stringList
+	nameInclude         *regexp.Regexp
+	nameExclude         *regexp.Regexp
+	netInclude          *regexp.Regexp
+	netExclude          *regexp.Regexp
+	netAggregate        bool
+	noInfo              bool
+	noNetwork           bool
+	watchUpdates        bool
+	infoLabels          stringList
+	metricGroups        stringList
+	infoCommand         bool
+	mountInfo           bool
+	maxPerCPU           int
+	maxContainers       int
+	nameStrategy        string
+	logPath             bool
+	composeProjectLabel string
+	composeServiceLabel string
+	commandLength       int
+	concurrency         int
+	dockerTimeout       time.Duration
+	dockerHosts         stringList
+	dockerTLSCert       string
+	dockerTLSKey        string
+	dockerTLSCA         string
+	dockerVersion       string
+
+	inspectCacheTTL time.Duration
+	metricsPath     string
+	tlsCert         string
+	tlsKey          string
+	authUser        string
+	authPass        string
+	goMetrics       bool
+	once            bool
+	pprofEnabled    bool
+	output          string
+	graphiteAddr    string
+	otlpEndpoint    string
+
+	configPath string
+
+	registry *prometheus.Registry
+	basepath string
+
+	knownDataNames map[string]prometheus.Labels
 
 	pids           *prometheus.GaugeVec
-	cpuUsageUser   *prometheus.GaugeVec
-	cpuUsageKernel *prometheus.GaugeVec
-	cpuUsageTotal  *prometheus.GaugeVec
+	pidsLimit      *prometheus.GaugeVec
+	cpuUsageUser   *counterVec
+	cpuUsageKernel *counterVec
+	cpuUsageTotal  *counterVec
+	cpuUsagePerCPU *counterVec
+	cpuOnline      *prometheus.GaugeVec
+	cpuUsage       *prometheus.GaugeVec
+	cpuLimit       *prometheus.GaugeVec
 	memoryUsage    *prometheus.GaugeVec
 	memoryLimit    *prometheus.GaugeVec
+	memoryReserve  *prometheus.GaugeVec
+	memoryRSS      *prometheus.GaugeVec
+	memoryWorking  *prometheus.GaugeVec
+	memoryCache    *prometheus.GaugeVec
+	memorySwap     *prometheus.GaugeVec
+	memoryMaxUsage *prometheus.GaugeVec
+	memoryFailcnt  *counterVec
+	memoryPercent  *prometheus.GaugeVec
+	statsRead      *prometheus.GaugeVec
+	currentState   *prometheus.GaugeVec
+	restartCount   *prometheus.GaugeVec
+	restartTotal   *counterVec
+	createdTime    *prometheus.GaugeVec
+	imageCreated   *prometheus.GaugeVec
+	startedTime    *prometheus.GaugeVec
+	exitCode       *prometheus.GaugeVec
+	uptime         *prometheus.GaugeVec
+	sizeRw         *prometheus.GaugeVec
+	sizeRootFs     *prometheus.GaugeVec
+	lastSeen       *prometheus.GaugeVec
+	mountsCount    *prometheus.GaugeVec
+	mountInfoVec   *prometheus.GaugeVec
+	networkInfo    *prometheus.GaugeVec
+	logInfo        *prometheus.GaugeVec
+	privileged     *prometheus.GaugeVec
+	runsAsRoot     *prometheus.GaugeVec
+	capabilities   *prometheus.GaugeVec
+	restartPolicy  *prometheus.GaugeVec
+	restartRetries *prometheus.GaugeVec
+	deviceCount    *prometheus.GaugeVec
+	gpuInfo        *prometheus.GaugeVec
+	oomEvents      *prometheus.CounterVec
+
+	healthStatus        *prometheus.GaugeVec
+	healthFailingStreak *prometheus.GaugeVec
 
-	networkReceiveBytes    *prometheus.GaugeVec
-	networkTransmitBytes   *prometheus.GaugeVec
-	networkReceivePackets  *prometheus.GaugeVec
-	networkTransmitPackets *prometheus.GaugeVec
-	networkReceiveErrors   *prometheus.GaugeVec
-	networkTransmitErrors  *prometheus.GaugeVec
-	networkReceiveDropped  *prometheus.GaugeVec
-	networkTransmitDropped *prometheus.GaugeVec
+	networkReceiveBytes    *counterVec
+	networkTransmitBytes   *counterVec
+	networkReceivePackets  *counterVec
+	networkTransmitPackets *counterVec
+	networkReceiveErrors   *counterVec
+	networkTransmitErrors  *counterVec
+	networkReceiveDropped  *counterVec
+	networkTransmitDropped *counterVec
 
 	diskIOBytes *prometheus.GaugeVec
 
+	blkioReadBytes  *counterVec
+	blkioWriteBytes *counterVec
+	blkioReadOps    *counterVec
+	blkioWriteOps   *counterVec
+
 	containerInfo *prometheus.GaugeVec
+
+	dataFree       *prometheus.GaugeVec
+	dataAvailable  *prometheus.GaugeVec
+	dataSize       *prometheus.GaugeVec
+	dataInodesFree *prometheus.GaugeVec
+	dataInodes     *prometheus.GaugeVec
+
+	scrapeErrors        *prometheus.CounterVec
+	scrapeDuration      *prometheus.GaugeVec
+	lastScrapeTimestamp *prometheus.GaugeVec
+	clockSkew           *prometheus.GaugeVec
+	scrapesTotal        *prometheus.CounterVec
+	buildInfo           *prometheus.GaugeVec
+
+	daemonInfo        *prometheus.GaugeVec
+	containersTotal   *prometheus.GaugeVec
+	containersRunning *prometheus.GaugeVec
+	containerAge      *prometheus.HistogramVec
 )
 
+// stringList is a flag that can be repeated or given as a comma separated list.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// envString returns the value of the environment variable key, or def if it is unset.
+func envString(key, def string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return def
+}
+
+// envBool returns the environment variable key parsed as a boolean, or def if it is unset.
+func envBool(key string, def bool) bool {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		fatal("Invalid boolean in environment variable", "variable", key, "error", err)
+	}
+	return b
+}
+
+// envInt returns the environment variable key parsed as an integer, or def if it is unset.
+func envInt(key string, def int) int {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		fatal("Invalid integer in environment variable", "variable", key, "error", err)
+	}
+	return i
+}
+
+// envDuration returns the environment variable key parsed as a duration, or def if it is unset.
+func envDuration(key string, def time.Duration) time.Duration {
+	value, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		fatal("Invalid duration in environment variable", "variable", key, "error", err)
+	}
+	return d
+}
+
+func parseFlags() {
+	flag.DurationVar(&interval, "interval", envDuration("DOCKER_STATS_INTERVAL", 10*time.Second), "Interval between container scrapes (env DOCKER_STATS_INTERVAL)")
+	flag.BoolVar(&all, "all", envBool("DOCKER_STATS_ALL", false), "Include stopped containers (env DOCKER_STATS_ALL)")
+	extraLabels.Set(envString("DOCKER_STATS_LABELS", ""))
+	flag.Var(&extraLabels, "label", "Docker label to add as a label on all container metrics, can be repeated or comma separated (env DOCKER_STATS_LABELS)")
+	envLabels.Set(envString("DOCKER_STATS_ENV_LABELS", ""))
+	flag.Var(&envLabels, "env-label", "Environment variable of the containers to add as a label on all container metrics, can be repeated or comma separated (env DOCKER_STATS_ENV_LABELS)")
+	listFilters.Set(envString("DOCKER_STATS_FILTERS", ""))
+	flag.Var(&listFilters, "filter", "Docker container list filter such as label=key=value, name=foo or status=running, can be repeated or comma separated (env DOCKER_STATS_FILTERS)")
+	flag.StringVar(&composeProjectLabel, "compose-project-label", envString("DOCKER_STATS_COMPOSE_PROJECT_LABEL", "com.docker.compose.project"), "Docker label to take the compose_project label from (env DOCKER_STATS_COMPOSE_PROJECT_LABEL)")
+	flag.StringVar(&composeServiceLabel, "compose-service-label", envString("DOCKER_STATS_COMPOSE_SERVICE_LABEL", "com.docker.compose.service"), "Docker label to take the compose_service label from (env DOCKER_STATS_COMPOSE_SERVICE_LABEL)")
+	flag.String("name-include", envString("DOCKER_STATS_NAME_INCLUDE", ""), "Only export containers with names matching this regex (env DOCKER_STATS_NAME_INCLUDE)")
+	flag.StringVar(&nameStrategy, "name-strategy", envString("DOCKER_STATS_NAME_STRATEGY", "short"), "How to name containers in the container_name label, short for the name without the links of linked containers, full for the first name docker lists or id for the short container ID (env DOCKER_STATS_NAME_STRATEGY)")
+	flag.String("name-exclude", envString("DOCKER_STATS_NAME_EXCLUDE", ""), "Do not export containers with names matching this regex (env DOCKER_STATS_NAME_EXCLUDE)")
+	flag.String("net-interface-include", envString("DOCKER_STATS_NET_INTERFACE_INCLUDE", ""), "Only export network interfaces with names matching this regex (env DOCKER_STATS_NET_INTERFACE_INCLUDE)")
+	flag.String("net-interface-exclude", envString("DOCKER_STATS_NET_INTERFACE_EXCLUDE", ""), "Do not export network interfaces with names matching this regex (env DOCKER_STATS_NET_INTERFACE_EXCLUDE)")
+	flag.BoolVar(&netAggregate, "net-aggregate", envBool("DOCKER_STATS_NET_AGGREGATE", false), "Also export network metrics summed over all interfaces, with an empty interface label (env DOCKER_STATS_NET_AGGREGATE)")
+	flag.BoolVar(&noNetwork, "no-network", envBool("DOCKER_STATS_NO_NETWORK", false), "Do not export the network metrics of containers (env DOCKER_STATS_NO_NETWORK)")
+	flag.BoolVar(&noInfo, "no-info", envBool("DOCKER_STATS_NO_INFO", false), "Do not export the container_info metric (env DOCKER_STATS_NO_INFO)")
+	infoLabels.Set(envString("DOCKER_STATS_INFO_LABELS", ""))
+	metricGroups.Set(envString("DOCKER_STATS_METRICS", ""))
+	flag.Var(&metricGroups, "metrics", "Groups of container metrics to export, such as cpu, memory or network, can be repeated or comma separated, defaults to all (env DOCKER_STATS_METRICS)")
+	flag.Var(&infoLabels, "info-labels", "Labels to include on the container_info metric besides the container labels, such as container_id or container_image_name, can be repeated or comma separated, defaults to all (env DOCKER_STATS_INFO_LABELS)")
+	flag.BoolVar(&infoCommand, "info-command", envBool("DOCKER_STATS_INFO_COMMAND", false), "Add the command of the container as a container_command label on container_info (env DOCKER_STATS_INFO_COMMAND)")
+	flag.IntVar(&commandLength, "info-command-length", envInt("DOCKER_STATS_INFO_COMMAND_LENGTH", 100), "Maximum length of the container_command label, longer commands are truncated (env DOCKER_STATS_INFO_COMMAND_LENGTH)")
+	flag.BoolVar(&mountInfo, "mount-info", envBool("DOCKER_STATS_MOUNT_INFO", false), "Export a container_mount_info series for every mount of the containers (env DOCKER_STATS_MOUNT_INFO)")
+	flag.IntVar(&maxPerCPU, "max-percpu", envInt("DOCKER_STATS_MAX_PERCPU", 0), "Do not export per CPU usage of containers with more CPUs than this, 0 for no limit (env DOCKER_STATS_MAX_PERCPU)")
+	flag.BoolVar(&logPath, "log-info-path", envBool("DOCKER_STATS_LOG_INFO_PATH", false), "Add the path of the log file of the container as a log_path label on container_log_info (env DOCKER_STATS_LOG_INFO_PATH)")
+	flag.IntVar(&maxContainers, "max-containers", envInt("DOCKER_STATS_MAX_CONTAINERS", 0), "Maximum number of containers to scrape at a time, the others are scraped by turns in the following scrapes, 0 for no limit (env DOCKER_STATS_MAX_CONTAINERS)")
+	flag.BoolVar(&listSize, "size", envBool("DOCKER_STATS_SIZE", false), "Export container filesystem sizes, which is expensive for the daemon to calculate (env DOCKER_STATS_SIZE)")
+	flag.BoolVar(&watchUpdates, "events", envBool("DOCKER_STATS_EVENTS", false), "Scrape the containers right away when a container starts, dies or is removed, besides every interval (env DOCKER_STATS_EVENTS)")
+	flag.BoolVar(&stream, "stream", envBool("DOCKER_STATS_STREAM", false), "Read two frames from the streaming stats API to get accurate CPU usage percentages (env DOCKER_STATS_STREAM)")
+	flag.IntVar(&concurrency, "concurrency", envInt("DOCKER_STATS_CONCURRENCY", 8), "Number of containers to fetch stats for concurrently (env DOCKER_STATS_CONCURRENCY)")
+	flag.DurationVar(&dockerTimeout, "docker-timeout", envDuration("DOCKER_STATS_DOCKER_TIMEOUT", 5*time.Second), "Timeout for each docker API call (env DOCKER_STATS_DOCKER_TIMEOUT)")
+	flag.Var(&dockerHosts, "docker-host", "Docker daemon address such as unix:///var/run/docker.sock or tcp://host:2376, overrides DOCKER_HOST, can be repeated or comma separated to scrape several daemons")
+	flag.StringVar(&dockerTLSCert, "docker-tls-cert", "", "Client certificate for connecting to the docker daemon over TLS")
+	flag.StringVar(&dockerTLSKey, "docker-tls-key", "", "Client key for connecting to the docker daemon over TLS")
+	flag.StringVar(&dockerTLSCA, "docker-tls-ca", "", "CA certificate for verifying the docker daemon over TLS")
+	flag.StringVar(&dockerVersion, "docker-api-version", "", "Docker API version to use instead of negotiating it with the daemon, overrides DOCKER_API_VERSION")
+	flag.DurationVar(&inspectCacheTTL, "inspect-cache-ttl", envDuration("DOCKER_STATS_INSPECT_CACHE_TTL", time.Minute), "How long to cache container inspect results while the container state is unchanged, 0 to disable (env DOCKER_STATS_INSPECT_CACHE_TTL)")
+	flag.StringVar(&listen, "listen", envString("DOCKER_STATS_LISTEN", ":8080"), "Address to serve metrics on (env DOCKER_STATS_LISTEN)")
+	flag.StringVar(&metricsPath, "metrics-path", envString("DOCKER_STATS_METRICS_PATH", "/metrics"), "Path to serve metrics on (env DOCKER_STATS_METRICS_PATH)")
+	flag.StringVar(&tlsCert, "tls-cert", envString("DOCKER_STATS_TLS_CERT", ""), "Certificate to serve metrics over HTTPS with, requires -tls-key (env DOCKER_STATS_TLS_CERT)")
+	flag.BoolVar(&goMetrics, "go-metrics", envBool("DOCKER_STATS_GO_METRICS", false), "Export Go runtime and process metrics of the exporter itself (env DOCKER_STATS_GO_METRICS)")
+	flag.StringVar(&authUser, "auth-user", envString("DOCKER_STATS_AUTH_USER", ""), "Username required for basic auth on the metrics path, requires -auth-pass (env DOCKER_STATS_AUTH_USER)")
+	flag.StringVar(&authPass, "auth-pass", envString("DOCKER_STATS_AUTH_PASS", ""), "Password required for basic auth on the metrics path, requires -auth-user (env DOCKER_STATS_AUTH_PASS)")
+	flag.StringVar(&tlsKey, "tls-key", envString("DOCKER_STATS_TLS_KEY", ""), "Key to serve metrics over HTTPS with, requires -tls-cert (env DOCKER_STATS_TLS_KEY)")
+	logFormat := flag.String("log-format", envString("DOCKER_STATS_LOG_FORMAT", "text"), "Log format, text or json (env DOCKER_STATS_LOG_FORMAT)")
+	logLevel := flag.String("log-level", envString("DOCKER_STATS_LOG_LEVEL", "info"), "Log level, debug, info, warn or error (env DOCKER_STATS_LOG_LEVEL)")
+	flag.StringVar(&containerPrefix, "namespace", envString("DOCKER_STATS_NAMESPACE", "container_"), "Prefix of the per-container metric names (env DOCKER_STATS_NAMESPACE)")
+	flag.BoolVar(&pprofEnabled, "pprof", envBool("DOCKER_STATS_PPROF", false), "Serve the Go profiling endpoints under /debug/pprof/ (env DOCKER_STATS_PPROF)")
+	flag.StringVar(&output, "output", envString("DOCKER_STATS_OUTPUT", "prometheus"), "Where to export the metrics to, prometheus to only serve them on the metrics path, graphite to also push them to -graphite-addr or otlp to also push them to -otlp-endpoint every interval (env DOCKER_STATS_OUTPUT)")
+	flag.StringVar(&graphiteAddr, "graphite-addr", envString("DOCKER_STATS_GRAPHITE_ADDR", ""), "Address of the graphite plaintext listener such as graphite:2003, for -output graphite (env DOCKER_STATS_GRAPHITE_ADDR)")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", envString("DOCKER_STATS_OTLP_ENDPOINT", ""), "OTLP/HTTP endpoint of the collector such as http://otel-collector:4318, for -output otlp (env DOCKER_STATS_OTLP_ENDPOINT)")
+	flag.BoolVar(&once, "once", false, "Scrape once, print the metrics to stdout and exit, for debugging")
+	flag.StringVar(&configPath, "config", envString("DOCKER_STATS_CONFIG", ""), "YAML configuration file, flags and environment variables override the values in it (env DOCKER_STATS_CONFIG)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [basepath]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	basepath = flag.Arg(0)
+	if configPath != "" {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			fatal("Failed to load config", "error", err)
+		}
+		if err := config.apply(); err != nil {
+			fatal("Failed to apply config", "error", err)
+		}
+	}
+	setupLogging(*logFormat, *logLevel)
+	if err := validateFlags(); err != nil {
+		fatal("Invalid configuration", "error", err)
+	}
+}
+
+// validateFlags checks the flags and sets the values derived from them. It is called again with the
+// new flag values when the configuration is reloaded.
+func validateFlags() error {
+	if containerPrefix != "" && !strings.HasSuffix(containerPrefix, "_") {
+		containerPrefix += "_"
+	}
+	if containerPrefix != "" && !model.IsValidMetricName(model.LabelValue(containerPrefix)) {
+		return fmt.Errorf("invalid namespace %q", containerPrefix)
+	}
+	if interval <= 0 {
+		return errors.New("interval must be positive")
+	}
+	builtinLabels := map[string]bool{
+		"docker_host": true, "container_name": true, "compose_project": true, "compose_service": true, "container_id": true,
+		"swarm_service": true, "swarm_stack": true, "swarm_task": true,
+		"state": true, "health": true, "cpu": true, "interface": true, "op": true,
+		"source": true, "destination": true, "type": true, "network": true, "ip_address": true, "mac_address": true,
+		"log_driver": true, "log_path": true, "capability": true, "policy": true,
+		"driver": true, "count": true, "device_ids": true,
+	}
+	for _, name := range extraLabelNames() {
+		if builtinLabels[name] || strings.HasPrefix(name, "container_") || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("label %q conflicts with a built-in or another label", name)
+		}
+		builtinLabels[name] = true
+	}
+	for _, name := range infoLabels {
+		if !slices.Contains(allInfoLabels, name) {
+			return fmt.Errorf("unknown info label %q, valid labels are %s", name, strings.Join(allInfoLabels, ","))
+		}
+	}
+	if len(infoLabels) == 0 {
+		infoLabels = append(infoLabels, allInfoLabels...)
+	}
+	for _, group := range metricGroups {
+		if !slices.Contains(allMetricGroups, group) {
+			return fmt.Errorf("unknown metric group %q, valid groups are %s", group, strings.Join(allMetricGroups, ","))
+		}
+	}
+	var err error
+	if nameInclude, err = compileFlag("name-include"); err != nil {
+		return fmt.Errorf("invalid name include regex: %w", err)
+	}
+	if nameExclude, err = compileFlag("name-exclude"); err != nil {
+		return fmt.Errorf("invalid name exclude regex: %w", err)
+	}
+	if netInclude, err = compileFlag("net-interface-include"); err != nil {
+		return fmt.Errorf("invalid network interface include regex: %w", err)
+	}
+	if netExclude, err = compileFlag("net-interface-exclude"); err != nil {
+		return fmt.Errorf("invalid network interface exclude regex: %w", err)
+	}
+	if _, err := containerFilters(); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	if (dockerTLSCert == "") != (dockerTLSKey == "") {
+		return errors.New("both -docker-tls-cert and -docker-tls-key must be given")
+	}
+	if (tlsCert == "") != (tlsKey == "") {
+		return errors.New("both -tls-cert and -tls-key must be given")
+	}
+	if (authUser == "") != (authPass == "") {
+		return errors.New("both -auth-user and -auth-pass must be given")
+	}
+	if dockerTimeout <= 0 {
+		return errors.New("docker timeout must be positive")
+	}
+	if commandLength <= 0 {
+		return errors.New("command length must be positive")
+	}
+	if composeProjectLabel == "" || composeServiceLabel == "" {
+		return errors.New("compose project and service labels must not be empty")
+	}
+	if nameStrategy != "short" && nameStrategy != "full" && nameStrategy != "id" {
+		return fmt.Errorf("invalid name strategy %q, expected short, full or id", nameStrategy)
+	}
+	if maxContainers < 0 {
+		return errors.New("max containers must not be negative")
+	}
+	if maxPerCPU < 0 {
+		return errors.New("max per CPU must not be negative")
+	}
+	if concurrency <= 0 {
+		return errors.New("concurrency must be positive")
+	}
+	if _, port, err := net.SplitHostPort(listen); err != nil {
+		return fmt.Errorf("invalid listen address %q: %w", listen, err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port in listen address %q", listen)
+	}
+	switch output {
+	case "prometheus":
+	case "graphite":
+		if _, _, err := net.SplitHostPort(graphiteAddr); err != nil {
+			return fmt.Errorf("invalid graphite address %q: %w", graphiteAddr, err)
+		}
+	case "otlp":
+		if u, err := url.Parse(otlpEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q, expected an http or https URL", otlpEndpoint)
+		}
+	default:
+		return fmt.Errorf("invalid output %q, expected prometheus, graphite or otlp", output)
+	}
+	if !strings.HasPrefix(metricsPath, "/") || metricsPath == "/" {
+		return fmt.Errorf("invalid metrics path %q", metricsPath)
+	}
+	return nil
+}
+
+// compileFlag compiles the regex of a flag, nil when the flag is empty.
+func compileFlag(name string) (*regexp.Regexp, error) {
+	expr := flag.Lookup(name).Value.String()
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// metricEnabled returns whether the container metrics of a group are exported. -no-network and
+// -no-info turn off the network and info groups.
+func metricEnabled(group string) bool {
+	switch {
+	case group == "network" && noNetwork, group == "info" && noInfo:
+		return false
+	}
+	return len(metricGroups) == 0 || slices.Contains(metricGroups, group)
+}
+
+// setup creates the metrics and registers them in a new registry, replacing those of a previous
+// configuration.
 func setup() {
-	containerLabels := []string{"container_name", "compose_project", "compose_service"}
-	containerNetworkLabels := append(containerLabels, "interface")
-	containerDiskLabels := append(containerLabels, "op")
-	containerInfoLabels := []string{
-		"container_id",
+	registry = prometheus.NewRegistry()
+	knownDataNames = nil
+	dataPrefix := containerPrefix + "data_"
+	containerLabels := append([]string{
+		"docker_host",
 		"container_name",
 		"compose_project",
 		"compose_service",
-		"container_image_id",
-		"container_image_name",
-		"container_state",
-		"container_state_running",
-		"container_state_paused",
-		"container_state_restarting",
-		"container_state_oomkilled",
-		"container_state_dead",
+		"swarm_service",
+		"swarm_stack",
+		"swarm_task",
+	}, extraLabelNames()...)
+	withContainerLabels := func(labels ...string) []string {
+		return append(append([]string{}, containerLabels...), labels...)
+	}
+	containerStateLabels := withContainerLabels("state")
+	containerHealthLabels := withContainerLabels("health")
+	containerCPULabels := withContainerLabels("cpu")
+	containerNetworkLabels := withContainerLabels("interface")
+	containerDiskLabels := withContainerLabels("op")
+	containerMountLabels := withContainerLabels("source", "destination", "type")
+	containerNetworkInfoLabels := withContainerLabels("network", "ip_address", "mac_address")
+	containerLogLabels := withContainerLabels("log_driver")
+	containerCapabilityLabels := withContainerLabels("capability")
+	containerPolicyLabels := withContainerLabels("policy")
+	containerGPULabels := withContainerLabels("driver", "count", "device_ids")
+	if logPath {
+		containerLogLabels = append(containerLogLabels, "log_path")
+	}
+	dataLabels := []string{"data_name"}
+	containerInfoLabels := withContainerLabels(infoLabels...)
+	if infoCommand {
+		containerInfoLabels = append(containerInfoLabels, "container_command")
 	}
 
 	pids = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: containerPrefix + "pids",
 		Help: "Number of running processes in the container",
 	}, containerLabels)
-	cpuUsageUser = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	pidsLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "pids_limit",
+		Help: "Maximum number of processes in the container, 0 if unlimited",
+	}, containerLabels)
+	cpuUsageUser = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "cpu_usage_user_seconds_total",
 		Help: "Container CPU usage in user mode",
 	}, containerLabels)
-	cpuUsageKernel = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	cpuUsageKernel = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "cpu_usage_kernel_seconds_total",
 		Help: "Container CPU usage in kernel mode",
 	}, containerLabels)
-	cpuUsageTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	cpuUsageTotal = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "cpu_usage_seconds_total",
 		Help: "Container CPU usage",
 	}, containerLabels)
-	cpuUsageTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
-		Name: containerPrefix + "cpu_usage_seconds_total",
-		Help: "Container CPU usage",
+	cpuUsagePerCPU = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "cpu_usage_percpu_seconds_total",
+		Help: "Container CPU usage per CPU",
+	}, containerCPULabels)
+	cpuOnline = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "cpu_online_count",
+		Help: "Number of CPUs available to the container",
+	}, containerLabels)
+	cpuUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "cpu_usage_percent",
+		Help: "Container CPU usage percentage, where 100 equals one fully used CPU",
+	}, containerLabels)
+	cpuLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "cpu_limit_cores",
+		Help: "CPU limit of the container in cores, 0 if it has no limit",
 	}, containerLabels)
 	memoryUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: containerPrefix + "memory_usage_bytes",
@@ -93,38 +602,175 @@ func setup() {
 	}, containerLabels)
 	memoryLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: containerPrefix + "memory_limit_bytes",
-		Help: "Container Memory limit",
+		Help: "Container Memory limit, 0 if unlimited",
+	}, containerLabels)
+	memoryReserve = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_reservation_bytes",
+		Help: "Container Memory soft limit, for containers that have one",
+	}, containerLabels)
+	memoryWorking = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_working_set_bytes",
+		Help: "Container Memory usage without inactive page cache, as reported by the kubelet",
+	}, containerLabels)
+	memoryRSS = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_rss_bytes",
+		Help: "Container Memory RSS",
+	}, containerLabels)
+	memoryCache = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_cache_bytes",
+		Help: "Container Memory page cache",
+	}, containerLabels)
+	memorySwap = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_swap_bytes",
+		Help: "Container Memory swap usage",
+	}, containerLabels)
+	memoryMaxUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_max_usage_bytes",
+		Help: "Container Memory maximum recorded usage",
+	}, containerLabels)
+	memoryFailcnt = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "memory_failcnt_total",
+		Help: "Number of times the container Memory usage hit the limit",
+	}, containerLabels)
+	memoryPercent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "memory_usage_percent",
+		Help: "Container Memory usage percentage of the limit",
+	}, containerLabels)
+	statsRead = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "stats_read_timestamp_seconds",
+		Help: "Time the docker daemon sampled the container stats",
+	}, containerLabels)
+	currentState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "state",
+		Help: "Container state, 1 for the current state and 0 for the others",
+	}, containerStateLabels)
+	restartCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "restart_count",
+		Help: "Number of times the container has been restarted",
+	}, containerLabels)
+	restartTotal = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "restart_count_total",
+		Help: "Number of times containers with these labels have been restarted since the exporter started, including containers they were recreated from",
+	}, containerLabels)
+	createdTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "created_timestamp_seconds",
+		Help: "Unix time of when the container was created",
+	}, containerLabels)
+	imageCreated = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "image_created_timestamp_seconds",
+		Help: "Unix time the image of the container was built at",
+	}, containerLabels)
+	startedTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "started_timestamp_seconds",
+		Help: "Unix time of when the container was last started, 0 if never started",
+	}, containerLabels)
+	exitCode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "exit_code",
+		Help: "Exit code of the last run of the container",
+	}, containerLabels)
+	uptime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "uptime_seconds",
+		Help: "Time since the container was started, 0 if not running",
+	}, containerLabels)
+	sizeRw = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "size_rw_bytes",
+		Help: "Size of the files created or changed in the container writable layer",
+	}, containerLabels)
+	sizeRootFs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "size_root_fs_bytes",
+		Help: "Total size of all the files in the container",
+	}, containerLabels)
+	lastSeen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "last_seen_timestamp_seconds",
+		Help: "Unix time of when the container was last seen, kept for a while after the container is gone",
+	}, containerLabels)
+	mountsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "mounts_count",
+		Help: "Number of bind mounts, volumes and tmpfs mounts of the container",
+	}, containerLabels)
+	mountInfoVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "mount_info",
+		Help: "Mounts of the container, always 1",
+	}, containerMountLabels)
+	networkInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "network_info",
+		Help: "Networks the container is attached to, with its addresses in them, always 1",
+	}, containerNetworkInfoLabels)
+	logInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "log_info",
+		Help: "Logging driver of the container, always 1",
+	}, containerLogLabels)
+	privileged = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "privileged",
+		Help: "Whether the container runs privileged, 1 or 0",
+	}, containerLabels)
+	runsAsRoot = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "runs_as_root",
+		Help: "Whether the container runs as root, 1 or 0",
+	}, containerLabels)
+	capabilities = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "capabilities_info",
+		Help: "Capabilities added to the container, always 1",
+	}, containerCapabilityLabels)
+	restartPolicy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "restart_policy",
+		Help: "Restart policy of the container, always 1",
+	}, containerPolicyLabels)
+	restartRetries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "restart_policy_max_retries",
+		Help: "Maximum number of restarts of the on-failure restart policy of the container, 0 for no limit",
+	}, containerLabels)
+	deviceCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "device_count",
+		Help: "Number of host devices mapped into the container",
+	}, containerLabels)
+	gpuInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "gpu_info",
+		Help: "GPUs requested by the container, always 1",
+	}, containerGPULabels)
+	oomEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "oom_events_total",
+		Help: "Number of OOM events of the container since the exporter started",
+	}, containerLabels)
+
+	healthStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "health_status",
+		Help: "Container health check status, always 1",
+	}, containerHealthLabels)
+	healthFailingStreak = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: containerPrefix + "health_failing_streak",
+		Help: "Number of consecutive failed container health checks",
 	}, containerLabels)
 
-	networkReceiveBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkReceiveBytes = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_receive_bytes_total",
 		Help: "Container network received bytes",
 	}, containerNetworkLabels)
-	networkTransmitBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkTransmitBytes = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_transmit_bytes_total",
 		Help: "Container network transmitted bytes",
 	}, containerNetworkLabels)
-	networkReceivePackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkReceivePackets = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_receive_packets_total",
 		Help: "Container network received packets",
 	}, containerNetworkLabels)
-	networkTransmitPackets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkTransmitPackets = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_transmit_packets_total",
 		Help: "Container network transmitted packets",
 	}, containerNetworkLabels)
-	networkReceiveErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkReceiveErrors = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_receive_errors_total",
 		Help: "Container network receive errors",
 	}, containerNetworkLabels)
-	networkTransmitErrors = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkTransmitErrors = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_transmit_errors_total",
 		Help: "Container network transmit errors",
 	}, containerNetworkLabels)
-	networkReceiveDropped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkReceiveDropped = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_receive_dropped_total",
 		Help: "Container network receive drops",
 	}, containerNetworkLabels)
-	networkTransmitDropped = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	networkTransmitDropped = newCounterVec(prometheus.CounterOpts{
 		Name: containerPrefix + "network_transmit_dropped_total",
 		Help: "Container network transmit drops",
 	}, containerNetworkLabels)
@@ -134,183 +780,1783 @@ func setup() {
 		Help: "Container disk IO bytes",
 	}, containerDiskLabels)
 
+	blkioReadBytes = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "blkio_read_bytes_total",
+		Help: "Container block IO bytes read",
+	}, containerLabels)
+	blkioWriteBytes = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "blkio_write_bytes_total",
+		Help: "Container block IO bytes written",
+	}, containerLabels)
+	blkioReadOps = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "blkio_read_ops_total",
+		Help: "Container block IO read operations",
+	}, containerLabels)
+	blkioWriteOps = newCounterVec(prometheus.CounterOpts{
+		Name: containerPrefix + "blkio_write_ops_total",
+		Help: "Container block IO write operations",
+	}, containerLabels)
+
 	containerInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: containerPrefix + "info",
 		Help: "Container info",
 	}, containerInfoLabels)
 
-	prometheus.MustRegister(pids)
-	prometheus.MustRegister(cpuUsageUser)
-	prometheus.MustRegister(cpuUsageKernel)
-	prometheus.MustRegister(cpuUsageTotal)
-	prometheus.MustRegister(memoryUsage)
-	prometheus.MustRegister(memoryLimit)
-
-	prometheus.MustRegister(networkReceiveBytes)
-	prometheus.MustRegister(networkTransmitBytes)
-	prometheus.MustRegister(networkReceivePackets)
-	prometheus.MustRegister(networkTransmitPackets)
-	prometheus.MustRegister(networkReceiveErrors)
-	prometheus.MustRegister(networkTransmitErrors)
-	prometheus.MustRegister(networkReceiveDropped)
-	prometheus.MustRegister(networkTransmitDropped)
-
-	prometheus.MustRegister(diskIOBytes)
-
-	prometheus.MustRegister(containerInfo)
-}
-
-func updateContainers(docker *client.Client) {
-	newKnownContainerIDs := make(map[string]prometheus.Labels)
-	newKnownContainerNetworks := make(map[string]prometheus.Labels)
-	newKnownContainerDiskStats := make(map[string]prometheus.Labels)
-	newKnownContainerInfos := make(map[string]prometheus.Labels)
-	containers, err := docker.ContainerList(context.Background(), types.ContainerListOptions{})
-	if err != nil {
-		log.Print("Failed to get container list: ", err)
+	dataFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dataPrefix + "free_bytes",
+		Help: "Free bytes on the data filesystem",
+	}, dataLabels)
+	dataAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dataPrefix + "available_bytes",
+		Help: "Bytes available to unprivileged users on the data filesystem",
+	}, dataLabels)
+	dataSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dataPrefix + "size_bytes",
+		Help: "Total size of the data filesystem",
+	}, dataLabels)
+	dataInodesFree = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dataPrefix + "inodes_free",
+		Help: "Free inodes on the data filesystem",
+	}, dataLabels)
+	dataInodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dataPrefix + "inodes",
+		Help: "Total inodes on the data filesystem",
+	}, dataLabels)
+
+	scrapeErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: exporterPrefix + "scrape_errors_total",
+		Help: "Number of errors while scraping docker",
+	}, []string{"docker_host", "operation"})
+	scrapeDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: exporterPrefix + "scrape_duration_seconds",
+		Help: "Duration of the last container scrape",
+	}, []string{"docker_host"})
+	lastScrapeTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: exporterPrefix + "last_scrape_timestamp_seconds",
+		Help: "Unix time of when the last container scrape completed",
+	}, []string{"docker_host"})
+	clockSkew = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: exporterPrefix + "daemon_clock_skew_seconds",
+		Help: "How far the clock of the docker daemon is behind the clock of the exporter, from the freshest container stats of the last scrape",
+	}, []string{"docker_host"})
+	scrapesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: exporterPrefix + "scrapes_total",
+		Help: "Number of container scrapes completed",
+	}, []string{"docker_host"})
+
+	// Container metrics are only registered for the groups selected with -metrics
+	register := func(group string, collectors ...prometheus.Collector) {
+		if metricEnabled(group) {
+			registry.MustRegister(collectors...)
+		}
 	}
-	for _, container := range containers {
-		inspect, err := docker.ContainerInspect(context.Background(), container.ID)
-		if err != nil {
-			log.Print("Failed to inspect container: ", err)
+	register("pids", pids, pidsLimit)
+	register("cpu", cpuUsageUser, cpuUsageKernel, cpuUsageTotal, cpuUsagePerCPU, cpuOnline, cpuUsage, cpuLimit)
+	register("memory", memoryUsage, memoryLimit, memoryReserve, memoryWorking, memoryRSS, memoryCache, memorySwap,
+		memoryMaxUsage, memoryFailcnt, memoryPercent, oomEvents)
+	register("state", currentState, createdTime, imageCreated, startedTime, exitCode, uptime, sizeRw, sizeRootFs, lastSeen,
+		statsRead)
+	register("restart", restartCount, restartTotal, restartPolicy, restartRetries)
+	register("mounts", mountsCount)
+	if mountInfo {
+		register("mounts", mountInfoVec)
+	}
+	register("log", logInfo)
+	register("privileges", privileged, runsAsRoot, capabilities)
+	register("devices", deviceCount, gpuInfo)
+	register("health", healthStatus, healthFailingStreak)
+
+	register("network", networkInfo, networkReceiveBytes, networkTransmitBytes, networkReceivePackets,
+		networkTransmitPackets, networkReceiveErrors, networkTransmitErrors, networkReceiveDropped, networkTransmitDropped)
+
+	register("blkio", diskIOBytes, blkioReadBytes, blkioWriteBytes, blkioReadOps, blkioWriteOps)
+
+	register("info", containerInfo)
+
+	registry.MustRegister(dataFree)
+	registry.MustRegister(dataAvailable)
+	registry.MustRegister(dataSize)
+	registry.MustRegister(dataInodesFree)
+	registry.MustRegister(dataInodes)
+
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: exporterPrefix + "build_info",
+		Help: "Build information of the exporter, always 1",
+	}, []string{"version", "commit", "go_version"})
+	buildInfo.WithLabelValues(version, commit, runtime.Version()).Set(1)
+
+	daemonInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dockerPrefix + "daemon_info",
+		Help: "Docker daemon information, always 1",
+	}, []string{"docker_host", "version", "api_version", "os", "arch", "kernel_version"})
+	containersTotal = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dockerPrefix + "containers_total",
+		Help: "Number of containers on the docker host, including stopped ones",
+	}, []string{"docker_host"})
+	containersRunning = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: dockerPrefix + "containers_running",
+		Help: "Number of running containers on the docker host",
+	}, []string{"docker_host"})
+	containerAge = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: dockerPrefix + "container_age_seconds",
+		Help: "How long the running containers on the docker host have been running, as of the last scrape",
+		// A minute, ten minutes, an hour, six hours, a day, a week and 30 days
+		Buckets: []float64{60, 600, 3600, 21600, 86400, 604800, 2592000},
+	}, []string{"docker_host"})
+
+	registry.MustRegister(scrapeErrors)
+	registry.MustRegister(scrapeDuration)
+	registry.MustRegister(lastScrapeTimestamp)
+	registry.MustRegister(clockSkew)
+	registry.MustRegister(scrapesTotal)
+	registry.MustRegister(buildInfo)
+
+	registry.MustRegister(daemonInfo)
+	registry.MustRegister(containersTotal)
+	registry.MustRegister(containersRunning)
+	registry.MustRegister(containerAge)
+
+	if goMetrics {
+		registry.MustRegister(collectors.NewGoCollector())
+		registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	}
+}
+
+// sanitizeLabelName turns a docker label key into a valid Prometheus label name.
+func sanitizeLabelName(key string) string {
+	name := []byte(key)
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0) {
+			name[i] = '_'
+		}
+	}
+	return string(name)
+}
+
+// extraLabelNames returns the Prometheus label names of the docker labels given with -label and
+// the environment variables given with -env-label.
+func extraLabelNames() []string {
+	var names []string
+	for _, key := range extraLabels {
+		names = append(names, sanitizeLabelName(key))
+	}
+	for _, key := range envLabels {
+		names = append(names, sanitizeLabelName(key))
+	}
+	return names
+}
+
+// containerFilters returns the -filter flags as docker container list filters.
+func containerFilters() (filters.Args, error) {
+	args := filters.NewArgs()
+	for _, filter := range listFilters {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return args, fmt.Errorf("invalid filter %q, expected key=value", filter)
+		}
+		args.Add(kv[0], kv[1])
+	}
+	return args, nil
+}
+
+// containerName returns the name of a container according to -name-strategy. Orphaned containers and
+// containers that are being removed can have no names, the short container ID is used for those.
+func containerName(container types.Container) string {
+	if len(container.Names) == 0 || nameStrategy == "id" {
+		return shortID(container.ID)
+	}
+	if nameStrategy == "full" {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	// Containers linked to others also have names like /parent/child for each link, the name of
+	// the container itself is the one without a parent
+	for _, name := range container.Names {
+		if strings.Count(name, "/") <= 1 {
+			return strings.TrimPrefix(name, "/")
+		}
+	}
+	return path.Base(container.Names[0])
+}
+
+// shortID returns the short form of a container ID, as shown by docker ps.
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// includeContainer reports whether a container passes the -name-include and -name-exclude filters.
+func includeContainer(container types.Container) bool {
+	name := containerName(container)
+	if nameInclude != nil && !nameInclude.MatchString(name) {
+		return false
+	}
+	return nameExclude == nil || !nameExclude.MatchString(name)
+}
+
+// includeInterface returns whether the network interface passes the -net-interface-include and
+// -net-interface-exclude regexes.
+func includeInterface(intf string) bool {
+	if netInclude != nil && !netInclude.MatchString(intf) {
+		return false
+	}
+	return netExclude == nil || !netExclude.MatchString(intf)
+}
+
+// labelsFor returns the labels identifying a container on all per-container metrics.
+func (d *daemon) labelsFor(container types.Container) prometheus.Labels {
+	labels := prometheus.Labels{
+		"docker_host":     d.name,
+		"container_name":  containerName(container),
+		"compose_project": container.Labels[composeProjectLabel],
+		"compose_service": container.Labels[composeServiceLabel],
+		"swarm_service":   container.Labels["com.docker.swarm.service.name"],
+		"swarm_stack":     container.Labels["com.docker.stack.namespace"],
+		"swarm_task":      container.Labels["com.docker.swarm.task.name"],
+	}
+	for _, key := range extraLabels {
+		labels[sanitizeLabelName(key)] = container.Labels[key]
+	}
+	if len(envLabels) > 0 {
+		d.envMu.Lock()
+		env := d.env[container.ID]
+		d.envMu.Unlock()
+		for _, key := range envLabels {
+			labels[sanitizeLabelName(key)] = env[key]
+		}
+	}
+	return labels
+}
+
+// windowsStats reports whether the stats come from a Windows container. NumProcs is only populated
+// on Windows, and Windows reports CPU usage in 100ns intervals and memory as private working set.
+func windowsStats(stats types.StatsJSON) bool {
+	return stats.NumProcs > 0
+}
+
+// cpuSeconds converts CPU usage reported by docker into seconds.
+func cpuSeconds(stats types.StatsJSON, usage uint64) float64 {
+	if windowsStats(stats) {
+		return float64(usage) / 1e7
+	}
+	return float64(usage) / 1e9
+}
+
+// onlineCPUs returns the number of CPUs available to the container. Older daemons don't
+// populate OnlineCPUs, so fall back to the length of the per CPU usage in that case.
+func onlineCPUs(stats types.StatsJSON) uint32 {
+	if windowsStats(stats) {
+		return stats.NumProcs
+	}
+	if stats.CPUStats.OnlineCPUs != 0 {
+		return stats.CPUStats.OnlineCPUs
+	}
+	return uint32(len(stats.CPUStats.CPUUsage.PercpuUsage))
+}
+
+// cpuPercent calculates the CPU usage percentage the same way as docker stats does. Returns 0
+// when there is no previous sample to compare against.
+func cpuPercent(stats types.StatsJSON) float64 {
+	if windowsStats(stats) {
+		return cpuPercentWindows(stats)
+	}
+	if stats.PreCPUStats.SystemUsage == 0 || stats.CPUStats.SystemUsage <= stats.PreCPUStats.SystemUsage {
+		return 0
+	}
+	if stats.CPUStats.CPUUsage.TotalUsage < stats.PreCPUStats.CPUUsage.TotalUsage {
+		return 0
+	}
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage - stats.PreCPUStats.SystemUsage)
+	return cpuDelta / systemDelta * float64(onlineCPUs(stats)) * 100
+}
+
+// cpuPercentWindows calculates the CPU usage percentage of a Windows container, which has no system
+// CPU usage, from the number of 100ns intervals available between the two samples.
+func cpuPercentWindows(stats types.StatsJSON) float64 {
+	if stats.PreRead.IsZero() || !stats.Read.After(stats.PreRead) {
+		return 0
+	}
+	if stats.CPUStats.CPUUsage.TotalUsage < stats.PreCPUStats.CPUUsage.TotalUsage {
+		return 0
+	}
+	possibleIntervals := float64(stats.Read.Sub(stats.PreRead).Nanoseconds()) / 100 * float64(stats.NumProcs)
+	usedIntervals := float64(stats.CPUStats.CPUUsage.TotalUsage - stats.PreCPUStats.CPUUsage.TotalUsage)
+	return usedIntervals / possibleIntervals * 100
+}
+
+// cpuLimitCores returns the CPU limit of a container in cores, set with --cpus or with --cpu-quota and
+// --cpu-period, or 0 if it has no limit.
+func cpuLimitCores(inspect types.ContainerJSON) float64 {
+	if inspect.HostConfig == nil {
+		return 0
+	}
+	if inspect.HostConfig.NanoCPUs > 0 {
+		return float64(inspect.HostConfig.NanoCPUs) / 1e9
+	}
+	if inspect.HostConfig.CPUQuota > 0 {
+		period := inspect.HostConfig.CPUPeriod
+		if period <= 0 {
+			// The default CFS period
+			period = 100000
+		}
+		return float64(inspect.HostConfig.CPUQuota) / float64(period)
+	}
+	return 0
+}
+
+// cgroupV1 reports whether the memory stats come from cgroup v1. The "cache" key only exists
+// in the cgroup v1 memory.stat, cgroup v2 has "inactive_file" and "file" instead.
+func cgroupV1(memStats types.MemoryStats) bool {
+	_, ok := memStats.Stats["cache"]
+	return ok
+}
+
+// memoryStat returns the memory.stat value of v1Key on cgroup v1 hosts, and of v2Key on cgroup v2 hosts.
+func memoryStat(memStats types.MemoryStats, v1Key, v2Key string) uint64 {
+	if cgroupV1(memStats) {
+		return memStats.Stats[v1Key]
+	}
+	return memStats.Stats[v2Key]
+}
+
+// memoryUsageBytes returns the memory usage without page cache, matching what docker stats reports.
+func memoryUsageBytes(memStats types.MemoryStats) uint64 {
+	if memStats.PrivateWorkingSet != 0 {
+		// Windows
+		return memStats.PrivateWorkingSet
+	}
+	cache := memoryStat(memStats, "cache", "inactive_file")
+	if cache > memStats.Usage {
+		return memStats.Usage
+	}
+	return memStats.Usage - cache
+}
+
+// memoryWorkingSet returns the memory usage without inactive page cache, matching the working set
+// reported by cAdvisor and the kubelet. Missing inactive_file stats count as no inactive page cache.
+func memoryWorkingSet(memStats types.MemoryStats) uint64 {
+	if memStats.PrivateWorkingSet != 0 {
+		// Windows
+		return memStats.PrivateWorkingSet
+	}
+	inactive := memoryStat(memStats, "total_inactive_file", "inactive_file")
+	if inactive > memStats.Usage {
+		return 0
+	}
+	return memStats.Usage - inactive
+}
+
+// memoryLimit returns the memory limit of a container, or 0 if it has no limit. Docker reports the
+// memory of the host, or a huge value, as the limit of containers without one.
+func (d *daemon) memoryLimit(memStats types.MemoryStats) uint64 {
+	if memStats.Limit >= unlimitedMemory || (d.memTotal > 0 && memStats.Limit >= uint64(d.memTotal)) {
+		return 0
+	}
+	return memStats.Limit
+}
+
+// memoryUsagePercent returns the memory usage as a percentage of the limit, or 0 if the container
+// has no limit.
+func memoryUsagePercent(memStats types.MemoryStats, limit uint64) float64 {
+	if limit == 0 {
+		return 0
+	}
+	return float64(memoryUsageBytes(memStats)) / float64(limit) * 100
+}
+
+// parseTime parses an RFC3339 timestamp reported by docker. Returns false for unparseable and
+// zero value (0001-01-01T00:00:00Z) timestamps.
+func parseTime(value string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || t.IsZero() {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// timestamp parses an RFC3339 timestamp reported by docker into Unix seconds, or 0 if it is unset.
+func timestamp(value string) float64 {
+	t, ok := parseTime(value)
+	if !ok {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// sumBlkio sums the read and write values of blkio entries across all devices.
+func sumBlkio(entries []types.BlkioStatEntry) (read, write uint64) {
+	for _, entry := range entries {
+		// cgroup v1 reports "Read"/"Write", cgroup v2 reports "read"/"write"
+		switch strings.ToLower(entry.Op) {
+		case "read":
+			read += entry.Value
+		case "write":
+			write += entry.Value
+		}
+	}
+	return read, write
+}
+
+// containerCommand returns the entrypoint and arguments the container runs, truncated to
+// -info-command-length characters.
+func containerCommand(inspect types.ContainerJSON) string {
+	command := []rune(strings.Join(append([]string{inspect.Path}, inspect.Args...), " "))
+	if len(command) > commandLength {
+		command = command[:commandLength]
+	}
+	return string(command)
+}
+
+// lastSeenContainer is when a container was last seen, and with which labels.
+type lastSeenContainer struct {
+	labels prometheus.Labels
+	time   time.Time
+}
+
+// restartCounts are the restart counts of the containers with the same labels, by container ID, so
+// that recreating a container does not reset container_restart_count_total.
+type restartCounts struct {
+	labels   prometheus.Labels
+	restarts map[string]int
+	// Restarts of containers that are gone, or from before their restart count was reset
+	removed int
+	// When the last container with the labels went away
+	empty time.Time
+}
+
+// countRestarts records the restart count of a container, returning the total restarts of the
+// containers with its labels.
+func (d *daemon) countRestarts(id string, labels prometheus.Labels, count int) float64 {
+	s, _ := json.Marshal(labels)
+	counts := d.restartCounts[string(s)]
+	if counts == nil {
+		counts = &restartCounts{labels: labels, restarts: make(map[string]int)}
+		d.restartCounts[string(s)] = counts
+	}
+	counts.empty = time.Time{}
+	// Starting a container by hand resets its restart count
+	if previous, ok := counts.restarts[id]; ok && count < previous {
+		counts.removed += previous
+	}
+	counts.restarts[id] = count
+	total := counts.removed
+	for _, restarts := range counts.restarts {
+		total += restarts
+	}
+	return float64(total)
+}
+
+// moveRestarts removes a renamed container from the restart counts of its previous labels. Its
+// restarts are counted for the new labels from then on.
+func (d *daemon) moveRestarts(id string, previous prometheus.Labels) {
+	s, _ := json.Marshal(previous)
+	if counts := d.restartCounts[string(s)]; counts != nil {
+		delete(counts.restarts, id)
+	}
+}
+
+// pruneRestartCounts removes the restart counters of labels without containers that are still seen.
+// Their totals are kept for as long as containers are considered recently seen, so that the counter
+// carries on if a container with the same labels shows up again.
+func (d *daemon) pruneRestartCounts() {
+	for key, counts := range d.restartCounts {
+		for id, restarts := range counts.restarts {
+			if _, ok := d.lastSeenContainers[id]; !ok {
+				counts.removed += restarts
+				delete(counts.restarts, id)
+			}
+		}
+		if len(counts.restarts) > 0 {
 			continue
 		}
-		resp, err := docker.ContainerStatsOneShot(context.Background(), container.ID)
-		if err != nil {
-			log.Print("Failed to get container stats: ", err)
+		if counts.empty.IsZero() {
+			restartTotal.Delete(counts.labels)
+			counts.empty = time.Now()
+		}
+		if counts.removed == 0 || time.Since(counts.empty) > lastSeenRetention {
+			delete(d.restartCounts, key)
+		}
+	}
+}
+
+// inspectCacheEntry is a cached container inspect result.
+type inspectCacheEntry struct {
+	inspect types.ContainerJSON
+	state   string
+	expires time.Time
+}
+
+// containerState returns the state of a container as seen in the container list, including the health
+// status docker appends to the human readable status, e.g. "Up 5 minutes (healthy)".
+func containerState(container types.Container) string {
+	state := container.State
+	if i := strings.LastIndex(container.Status, "("); i >= 0 && strings.HasSuffix(container.Status, ")") {
+		state += " " + container.Status[i:]
+	}
+	return state
+}
+
+// inspectContainer inspects a container. Results are cached until the state of the container changes
+// or the cache TTL expires, as most of the inspected fields never change for a container.
+func (d *daemon) inspectContainer(ctx context.Context, container types.Container) (types.ContainerJSON, error) {
+	state := containerState(container)
+	now := time.Now()
+	d.inspectCacheMu.Lock()
+	entry, ok := d.inspectCache[container.ID]
+	d.inspectCacheMu.Unlock()
+	if ok && entry.state == state && now.Before(entry.expires) {
+		return entry.inspect, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+	inspect, err := d.docker().ContainerInspect(ctx, container.ID)
+	if err != nil {
+		return inspect, err
+	}
+	if inspectCacheTTL > 0 {
+		d.inspectCacheMu.Lock()
+		d.inspectCache[container.ID] = inspectCacheEntry{inspect: inspect, state: state, expires: now.Add(inspectCacheTTL)}
+		d.inspectCacheMu.Unlock()
+	}
+	return inspect, nil
+}
+
+// forgetInspect removes the cached inspect result of a container, so that it is inspected again.
+func (d *daemon) forgetInspect(id string) {
+	d.inspectCacheMu.Lock()
+	delete(d.inspectCache, id)
+	d.inspectCacheMu.Unlock()
+}
+
+// imageInfo is the cached information of an image.
+type imageInfo struct {
+	digest string
+	// created is the Unix time the image was built at, 0 if unknown
+	created float64
+}
+
+// inspectImage returns the information of an image, inspecting it only if it is not cached yet.
+// The repo digest matching the name the container was created with is preferred.
+func (d *daemon) inspectImage(ctx context.Context, id, name string) imageInfo {
+	d.imageCacheMu.Lock()
+	info, ok := d.imageCache[id]
+	d.imageCacheMu.Unlock()
+	if ok {
+		return info
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+	image, _, err := d.docker().ImageInspectWithRaw(ctx, id)
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "image_inspect").Inc()
+		logThrottled(slog.LevelWarn, "Failed to inspect image", err, "docker_host", d.name, "image_id", id, "operation", "image_inspect")
+		return info
+	}
+	info.created = timestamp(image.Created)
+	repo := name
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, digest := range image.RepoDigests {
+		if strings.HasPrefix(digest, repo+"@") {
+			info.digest = digest
+			break
+		}
+	}
+	if info.digest == "" && len(image.RepoDigests) > 0 {
+		info.digest = image.RepoDigests[0]
+	}
+
+	d.imageCacheMu.Lock()
+	d.imageCache[id] = info
+	d.imageCacheMu.Unlock()
+	return info
+}
+
+// containerStats fetches the stats of a container. In stream mode the second frame of the stats stream
+// is used, as only that one has PreCPUStats populated.
+func (d *daemon) containerStats(ctx context.Context, id string) (types.StatsJSON, error) {
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+
+	docker := d.docker()
+	var stats types.StatsJSON
+	var resp types.ContainerStats
+	var err error
+	if stream {
+		resp, err = docker.ContainerStats(ctx, id, true)
+	} else {
+		resp, err = docker.ContainerStatsOneShot(ctx, id)
+	}
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "stats").Inc()
+		return stats, fmt.Errorf("fetching stats: %w", err)
+	}
+	defer resp.Body.Close()
+
+	frames := 1
+	if stream {
+		frames = 2
+	}
+	decoder := json.NewDecoder(resp.Body)
+	for i := 0; i < frames; i++ {
+		stats = types.StatsJSON{}
+		if err := decoder.Decode(&stats); err != nil {
+			scrapeErrors.WithLabelValues(d.name, "decode").Inc()
+			return stats, fmt.Errorf("decoding stats: %w", err)
+		}
+	}
+	return stats, nil
+}
+
+// setNetworkStats sets the network metrics with the given labels.
+func setNetworkStats(labels prometheus.Labels, net types.NetworkStats) {
+	networkReceiveBytes.With(labels).Set(float64(net.RxBytes))
+	networkTransmitBytes.With(labels).Set(float64(net.TxBytes))
+	networkReceivePackets.With(labels).Set(float64(net.RxPackets))
+	networkTransmitPackets.With(labels).Set(float64(net.TxPackets))
+	networkReceiveErrors.With(labels).Set(float64(net.RxErrors))
+	networkTransmitErrors.With(labels).Set(float64(net.TxErrors))
+	networkReceiveDropped.With(labels).Set(float64(net.RxDropped))
+	networkTransmitDropped.With(labels).Set(float64(net.TxDropped))
+}
+
+// containerSample is what is fetched from docker for a container in a scrape.
+type containerSample struct {
+	container types.Container
+	inspect   types.ContainerJSON
+	image     imageInfo
+	stats     types.StatsJSON
+	// Stopped containers have no stats, but their state and info are still exported
+	hasStats bool
+	// When the stats were received, to compare with when the daemon says it sampled them
+	received time.Time
+}
+
+// fetchContainer inspects a container and gets its stats, or returns nil if it cannot be inspected.
+func (d *daemon) fetchContainer(ctx context.Context, container types.Container) *containerSample {
+	inspect, err := d.inspectContainer(ctx, container)
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "inspect").Inc()
+		logThrottled(slog.LevelWarn, "Failed to inspect container", err, "docker_host", d.name, "container_id", container.ID, "operation", "inspect")
+		return nil
+	}
+	if len(envLabels) > 0 {
+		d.setContainerEnv(container.ID, inspect)
+	}
+	sample := &containerSample{
+		container: container,
+		inspect:   inspect,
+		image:     d.inspectImage(ctx, inspect.Image, container.Image),
+	}
+	// Only running containers, which includes paused ones, have stats. The daemon returns an empty
+	// sample or an error for the others, depending on its version.
+	if inspect.State == nil || !inspect.State.Running {
+		return sample
+	}
+	stats, err := d.containerStats(ctx, container.ID)
+	if err != nil {
+		logThrottled(slog.LevelWarn, "Failed to get container stats", err, "docker_host", d.name, "container_id", container.ID, "operation", "stats")
+	}
+	if err == nil && !stats.Read.IsZero() {
+		sample.stats = stats
+		sample.hasStats = true
+		sample.received = time.Now()
+	}
+	return sample
+}
+
+// setContainerEnv keeps the values of the -env-label environment variables of a container, and only
+// those, as other environment variables can hold secrets.
+func (d *daemon) setContainerEnv(id string, inspect types.ContainerJSON) {
+	env := make(map[string]string)
+	if inspect.Config != nil {
+		for _, kv := range inspect.Config.Env {
+			key, value, _ := strings.Cut(kv, "=")
+			if slices.Contains(envLabels, key) {
+				env[key] = value
+			}
+		}
+	}
+	d.envMu.Lock()
+	d.env[id] = env
+	d.envMu.Unlock()
+}
+
+// runsAsRootUser returns whether a container with the given user runs as root. The user is a name or
+// UID, optionally followed by a group, and is empty for containers using the default of root.
+func runsAsRootUser(user string) bool {
+	user, _, _ = strings.Cut(user, ":")
+	return user == "" || user == "root" || user == "0"
+}
+
+// requestsGPU returns whether a device request of a container is for GPUs, as made with --gpus.
+func requestsGPU(request container.DeviceRequest) bool {
+	for _, capabilities := range request.Capabilities {
+		if slices.Contains(capabilities, "gpu") {
+			return true
+		}
+	}
+	return false
+}
+
+// gpuCount returns the number of GPUs a device request is for, or "all" for --gpus all.
+func gpuCount(request container.DeviceRequest) string {
+	if request.Count < 0 {
+		return "all"
+	}
+	if len(request.DeviceIDs) > 0 {
+		return strconv.Itoa(len(request.DeviceIDs))
+	}
+	return strconv.Itoa(request.Count)
+}
+
+// updateClockSkew sets the clock skew of the daemon from the freshest stats of a scrape, the ones
+// received the soonest after the daemon sampled them, as the skew includes the time it took to
+// receive them. The skew is left out when no container had stats.
+func (d *daemon) updateClockSkew(samples []*containerSample) {
+	found := false
+	var skew time.Duration
+	for _, sample := range samples {
+		if sample == nil || !sample.hasStats {
 			continue
 		}
-		stats := types.StatsJSON{}
-		err = json.NewDecoder(resp.Body).Decode(&stats)
-		if err != nil {
-			log.Print("Failed to parse container stats: ", err)
+		if lag := sample.received.Sub(sample.stats.Read); !found || lag < skew {
+			skew = lag
+			found = true
+		}
+	}
+	if !found {
+		clockSkew.DeleteLabelValues(d.name)
+		return
+	}
+	clockSkew.WithLabelValues(d.name).Set(skew.Seconds())
+}
+
+// limitContainers returns the containers to scrape with -max-containers, taking turns between
+// scrapes, and the IDs of the containers left for later scrapes.
+func (d *daemon) limitContainers(containers []types.Container) ([]types.Container, map[string]bool) {
+	if maxContainers <= 0 || len(containers) <= maxContainers {
+		return containers, nil
+	}
+	logThrottled(slog.LevelWarn, "Scraping only some of the containers", errors.New("more containers than -max-containers"), "docker_host", d.name, "containers", len(containers), "max_containers", maxContainers)
+	start := d.nextContainer % len(containers)
+	var selected []types.Container
+	skipped := make(map[string]bool)
+	for i := range containers {
+		container := containers[(start+i)%len(containers)]
+		if i < maxContainers {
+			selected = append(selected, container)
+		} else {
+			skipped[container.ID] = true
+		}
+	}
+	d.nextContainer = start + maxContainers
+	slices.SortFunc(selected, func(a, b types.Container) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return selected, skipped
+}
+
+// keepSkipped copies the series of the given containers, such as those skipped by a scrape, from the
+// previous known series to the current ones. The keys of the known series start with the container ID.
+func keepSkipped(known, current map[string]prometheus.Labels, skipped map[string]bool) {
+	idLengths := make(map[int]bool)
+	for id := range skipped {
+		idLengths[len(id)] = true
+	}
+	for key, labels := range known {
+		for n := range idLengths {
+			if len(key) >= n && skipped[key[:n]] {
+				current[key] = labels
+				break
+			}
+		}
+	}
+}
+
+// recoverContainer recovers from a panic while processing a container, as a single malformed
+// container shouldn't take down the whole exporter. Must be deferred.
+func (d *daemon) recoverContainer(id string) {
+	if r := recover(); r != nil {
+		scrapeErrors.WithLabelValues(d.name, "panic").Inc()
+		slog.Error("Panic while processing container", "docker_host", d.name, "container_id", id, "operation", "panic", "panic", r, "stack", string(debug.Stack()))
+	}
+}
+
+// updateContainers updates all per-container metrics. The error of listing the containers is
+// returned, errors of individual containers are only logged and counted.
+func (d *daemon) updateContainers(ctx context.Context) error {
+	start := time.Now()
+	defer func() {
+		end := time.Now()
+		scrapeDuration.WithLabelValues(d.name).Set(end.Sub(start).Seconds())
+		lastScrapeTimestamp.WithLabelValues(d.name).Set(float64(end.UnixNano()) / 1e9)
+		scrapesTotal.WithLabelValues(d.name).Inc()
+	}()
+
+	if d.memTotal == 0 {
+		d.updateMemTotal(ctx)
+	}
+
+	// Sized after the previous scrape, as the containers seldom change between scrapes
+	newKnownContainerIDs := make(map[string]prometheus.Labels, len(d.knownContainerIDs))
+	newKnownContainerStates := make(map[string]prometheus.Labels, len(d.knownContainerStates))
+	newKnownContainerHealths := make(map[string]prometheus.Labels, len(d.knownContainerHealths))
+	newKnownHealthStatuses := make(map[string]prometheus.Labels, len(d.knownHealthStatuses))
+	newKnownContainerCPUs := make(map[string]prometheus.Labels, len(d.knownContainerCPUs))
+	newKnownContainerNetworks := make(map[string]prometheus.Labels, len(d.knownContainerNetworks))
+	newKnownContainerDiskStats := make(map[string]prometheus.Labels, len(d.knownContainerDiskStats))
+	newKnownContainerInfos := make(map[string]prometheus.Labels, len(d.knownContainerInfos))
+	newKnownContainerMounts := make(map[string]prometheus.Labels, len(d.knownContainerMounts))
+	newKnownNetworkInfos := make(map[string]prometheus.Labels, len(d.knownNetworkInfos))
+	newKnownLogInfos := make(map[string]prometheus.Labels, len(d.knownLogInfos))
+	newKnownCapabilities := make(map[string]prometheus.Labels, len(d.knownCapabilities))
+	newKnownRestartPolicies := make(map[string]prometheus.Labels, len(d.knownRestartPolicies))
+	newKnownGPUs := make(map[string]prometheus.Labels, len(d.knownGPUs))
+	listCtx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	// Filtering happens on the daemon, filtered out containers are pruned like removed ones
+	filterArgs, _ := containerFilters()
+	containers, err := d.docker().ContainerList(listCtx, types.ContainerListOptions{All: all, Size: listSize, Filters: filterArgs})
+	cancel()
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "list").Inc()
+		logThrottled(slog.LevelError, "Failed to get container list", err, "docker_host", d.name, "operation", "list")
+	} else {
+		d.updateContainerCounts(ctx, containers)
+	}
+	// Containers are fetched concurrently, but their metrics are updated one at a time in the order
+	// of their IDs, so that the result of a scrape does not depend on which API calls finish first
+	slices.SortFunc(containers, func(a, b types.Container) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	included := slices.DeleteFunc(slices.Clone(containers), func(container types.Container) bool {
+		return !includeContainer(container)
+	})
+	included, skipped := d.limitContainers(included)
+	samples := make([]*containerSample, len(included))
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, concurrency)
+	for i, container := range included {
+		i, container := i, container
+		wg.Add(1)
+		workers <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-workers }()
+			defer d.recoverContainer(container.ID)
+			samples[i] = d.fetchContainer(ctx, container)
+		}()
+	}
+	wg.Wait()
+	snapshot := make([]containerSnapshot, 0, len(included))
+	startTimes := make(map[string]time.Time, len(d.startTimes))
+	staleStats := make(map[string]bool)
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	d.updateClockSkew(samples)
+	for _, sample := range samples {
+		if sample == nil {
 			continue
 		}
-		resp.Body.Close()
+		func() {
+			defer d.recoverContainer(sample.container.ID)
+			container, inspect, image, stats, hasStats := sample.container, sample.inspect, sample.image, sample.stats, sample.hasStats
+
+			// Container state
+			{
+				labels := d.labelsFor(container)
+				newKnownContainerStates[container.ID] = labels
+				if previous, ok := d.lastSeenContainers[container.ID]; ok && !maps.Equal(previous.labels, labels) {
+					// Renamed, the series of the most recently seen container with the old labels
+					// are set again when pruning
+					lastSeen.Delete(previous.labels)
+					d.moveRestarts(container.ID, previous.labels)
+				}
+				d.lastSeenContainers[container.ID] = lastSeenContainer{labels: labels, time: time.Now()}
+
+				for _, state := range containerStates {
+					stateLabels := d.labelsFor(container)
+					stateLabels["state"] = state
+					if container.State == state {
+						currentState.With(stateLabels).Set(1)
+					} else {
+						currentState.With(stateLabels).Set(0)
+					}
+				}
+				restartCount.With(labels).Set(float64(inspect.RestartCount))
+				restartTotal.With(labels).Set(d.countRestarts(container.ID, labels, inspect.RestartCount))
+				createdTime.With(labels).Set(timestamp(inspect.Created))
+				imageCreated.With(labels).Set(image.created)
+				startedTime.With(labels).Set(timestamp(inspect.State.StartedAt))
+				exitCode.With(labels).Set(float64(inspect.State.ExitCode))
+				mountsCount.With(labels).Set(float64(len(inspect.Mounts)))
+				cpuLimit.With(labels).Set(cpuLimitCores(inspect))
+				if inspect.HostConfig != nil && inspect.HostConfig.MemoryReservation > 0 {
+					memoryReserve.With(labels).Set(float64(inspect.HostConfig.MemoryReservation))
+				} else {
+					memoryReserve.Delete(labels)
+				}
+				if startedAt, ok := parseTime(inspect.State.StartedAt); ok && inspect.State.Running {
+					startTimes[container.ID] = startedAt
+					uptime.With(labels).Set(time.Since(startedAt).Seconds())
+				} else {
+					uptime.With(labels).Set(0)
+				}
+				if listSize {
+					sizeRw.With(labels).Set(float64(container.SizeRw))
+					sizeRootFs.With(labels).Set(float64(container.SizeRootFs))
+				}
+			}
+
+			// Mounts
+			if mountInfo && metricEnabled("mounts") {
+				for _, mount := range inspect.Mounts {
+					labels := d.labelsFor(container)
+					labels["source"] = mount.Source
+					labels["destination"] = mount.Destination
+					labels["type"] = string(mount.Type)
+					newKnownContainerMounts[container.ID+"mount"+mount.Destination] = labels
+
+					mountInfoVec.With(labels).Set(1)
+				}
+			}
+
+			// Network addresses
+			if inspect.NetworkSettings != nil && metricEnabled("network") {
+				for name, network := range inspect.NetworkSettings.Networks {
+					if network == nil {
+						continue
+					}
+					labels := d.labelsFor(container)
+					labels["network"] = name
+					labels["ip_address"] = network.IPAddress
+					labels["mac_address"] = network.MacAddress
+					s, _ := json.Marshal(labels)
+					newKnownNetworkInfos[container.ID+string(s)] = labels
+
+					networkInfo.With(labels).Set(1)
+				}
+			}
+
+			// Privileges
+			if inspect.HostConfig != nil && metricEnabled("privileges") {
+				labels := d.labelsFor(container)
+				if inspect.HostConfig.Privileged {
+					privileged.With(labels).Set(1)
+				} else {
+					privileged.With(labels).Set(0)
+				}
+				if inspect.Config != nil && runsAsRootUser(inspect.Config.User) {
+					runsAsRoot.With(labels).Set(1)
+				} else {
+					runsAsRoot.With(labels).Set(0)
+				}
+				for _, capability := range inspect.HostConfig.CapAdd {
+					labels := d.labelsFor(container)
+					labels["capability"] = capability
+					newKnownCapabilities[container.ID+"capability"+capability] = labels
+
+					capabilities.With(labels).Set(1)
+				}
+			}
+
+			// Devices
+			if inspect.HostConfig != nil && metricEnabled("devices") {
+				labels := d.labelsFor(container)
+				deviceCount.With(labels).Set(float64(len(inspect.HostConfig.Devices)))
+				for _, request := range inspect.HostConfig.DeviceRequests {
+					if !requestsGPU(request) {
+						continue
+					}
+					labels := d.labelsFor(container)
+					labels["driver"] = request.Driver
+					labels["count"] = gpuCount(request)
+					labels["device_ids"] = strings.Join(request.DeviceIDs, ",")
+					s, _ := json.Marshal(labels)
+					newKnownGPUs[container.ID+string(s)] = labels
+
+					gpuInfo.With(labels).Set(1)
+				}
+			}
+
+			// Restart policy
+			if inspect.HostConfig != nil && metricEnabled("restart") {
+				labels := d.labelsFor(container)
+				restartRetries.With(labels).Set(float64(inspect.HostConfig.RestartPolicy.MaximumRetryCount))
+
+				policyLabels := d.labelsFor(container)
+				policyLabels["policy"] = inspect.HostConfig.RestartPolicy.Name
+				if policyLabels["policy"] == "" {
+					policyLabels["policy"] = "no"
+				}
+				s, _ := json.Marshal(policyLabels)
+				newKnownRestartPolicies[container.ID+string(s)] = policyLabels
+
+				restartPolicy.With(policyLabels).Set(1)
+			}
+
+			// Logging
+			if inspect.HostConfig != nil && metricEnabled("log") {
+				labels := d.labelsFor(container)
+				labels["log_driver"] = inspect.HostConfig.LogConfig.Type
+				if logPath {
+					labels["log_path"] = inspect.LogPath
+				}
+				s, _ := json.Marshal(labels)
+				newKnownLogInfos[container.ID+string(s)] = labels
+
+				logInfo.With(labels).Set(1)
+			}
+
+			// Health
+			if inspect.State.Health != nil && metricEnabled("health") {
+				labels := d.labelsFor(container)
+				statusLabels := d.labelsFor(container)
+				statusLabels["health"] = inspect.State.Health.Status
+				newKnownContainerHealths[container.ID] = labels
+				newKnownHealthStatuses[container.ID+"health"+inspect.State.Health.Status] = statusLabels
+
+				healthStatus.With(statusLabels).Set(1)
+				healthFailingStreak.With(labels).Set(float64(inspect.State.Health.FailingStreak))
+			}
+
+			// Running containers without stats, as when getting them timed out, keep the stats of the
+			// previous scrape. New ones get zeros for the gauges so that they are told apart from
+			// containers that are gone, but not for the counters, which would read as counter resets.
+			if !hasStats && container.State == "running" {
+				if _, ok := d.knownContainerIDs[container.ID]; ok {
+					staleStats[container.ID] = true
+				} else {
+					labels := d.labelsFor(container)
+					newKnownContainerIDs[container.ID] = labels
+
+					if metricEnabled("pids") {
+						pids.With(labels).Set(0)
+						pidsLimit.With(labels).Set(0)
+					}
+					if metricEnabled("cpu") {
+						cpuOnline.With(labels).Set(0)
+						cpuUsage.With(labels).Set(0)
+					}
+					if metricEnabled("memory") {
+						for _, gauge := range []*prometheus.GaugeVec{memoryUsage, memoryLimit, memoryWorking, memoryRSS, memoryCache, memorySwap, memoryMaxUsage, memoryPercent} {
+							gauge.With(labels).Set(0)
+						}
+					}
+					statsRead.With(labels).Set(0)
+				}
+			}
+
+			// General data
+			if hasStats {
+				labels := d.labelsFor(container)
+				newKnownContainerIDs[container.ID] = labels
+
+				if metricEnabled("pids") {
+					pids.With(labels).Set(float64(stats.PidsStats.Current))
+					if stats.PidsStats.Limit != math.MaxUint64 {
+						pidsLimit.With(labels).Set(float64(stats.PidsStats.Limit))
+					} else {
+						pidsLimit.With(labels).Set(0)
+					}
+				}
+				if metricEnabled("cpu") {
+					cpuUsageUser.With(labels).Set(cpuSeconds(stats, stats.CPUStats.CPUUsage.UsageInUsermode))
+					cpuUsageKernel.With(labels).Set(cpuSeconds(stats, stats.CPUStats.CPUUsage.UsageInKernelmode))
+					cpuUsageTotal.With(labels).Set(cpuSeconds(stats, stats.CPUStats.CPUUsage.TotalUsage))
+					cpuOnline.With(labels).Set(float64(onlineCPUs(stats)))
+					cpuUsage.With(labels).Set(cpuPercent(stats))
+				}
+				if metricEnabled("memory") {
+					memoryUsage.With(labels).Set(float64(memoryUsageBytes(stats.MemoryStats)))
+					memoryLimit.With(labels).Set(float64(d.memoryLimit(stats.MemoryStats)))
+					memoryWorking.With(labels).Set(float64(memoryWorkingSet(stats.MemoryStats)))
+					memoryRSS.With(labels).Set(float64(memoryStat(stats.MemoryStats, "rss", "anon")))
+					memoryCache.With(labels).Set(float64(memoryStat(stats.MemoryStats, "cache", "file")))
+					memorySwap.With(labels).Set(float64(stats.MemoryStats.Stats["swap"]))
+					memoryMaxUsage.With(labels).Set(float64(stats.MemoryStats.MaxUsage))
+					memoryFailcnt.With(labels).Set(float64(stats.MemoryStats.Failcnt))
+					memoryPercent.With(labels).Set(memoryUsagePercent(stats.MemoryStats, d.memoryLimit(stats.MemoryStats)))
+				}
+				statsRead.With(labels).Set(float64(stats.Read.UnixNano()) / 1e9)
+			}
+
+			// Per CPU usage, which on cgroup v1 can have entries for CPUs that are no longer online.
+			// Series of CPUs left out are pruned like those of removed containers.
+			perCPU := stats.CPUStats.CPUUsage.PercpuUsage
+			if online := int(onlineCPUs(stats)); len(perCPU) > online {
+				perCPU = perCPU[:online]
+			}
+			if maxPerCPU > 0 && len(perCPU) > maxPerCPU || !metricEnabled("cpu") {
+				perCPU = nil
+			}
+			for cpu, usage := range perCPU {
+				labels := d.labelsFor(container)
+				labels["cpu"] = strconv.Itoa(cpu)
+				newKnownContainerCPUs[container.ID+"cpu"+labels["cpu"]] = labels
+
+				cpuUsagePerCPU.With(labels).Set(cpuSeconds(stats, usage))
+			}
+
+			// Networks, without any series to prune when the network metrics are not exported
+			networks := stats.Networks
+			if !metricEnabled("network") {
+				networks = nil
+			}
+			var total types.NetworkStats
+			interfaces := 0
+			for intf, net := range networks {
+				if !includeInterface(intf) {
+					continue
+				}
+				labels := d.labelsFor(container)
+				labels["interface"] = intf
+				newKnownContainerNetworks[container.ID+intf] = labels
+				setNetworkStats(labels, net)
+
+				interfaces++
+				total.RxBytes += net.RxBytes
+				total.TxBytes += net.TxBytes
+				total.RxPackets += net.RxPackets
+				total.TxPackets += net.TxPackets
+				total.RxErrors += net.RxErrors
+				total.TxErrors += net.TxErrors
+				total.RxDropped += net.RxDropped
+				total.TxDropped += net.TxDropped
+			}
+			// The empty interface label is the same as no label in PromQL
+			if netAggregate && interfaces > 0 {
+				labels := d.labelsFor(container)
+				labels["interface"] = ""
+				newKnownContainerNetworks[container.ID] = labels
+				setNetworkStats(labels, total)
+			}
+
+			// Disk IO
+			if metricEnabled("blkio") {
+				for _, stat := range stats.BlkioStats.IoServiceBytesRecursive {
+					labels := d.labelsFor(container)
+					labels["op"] = stat.Op
+					newKnownContainerDiskStats[container.ID+"bytes"+stat.Op] = labels
+
+					diskIOBytes.With(labels).Set(float64(stat.Value))
+				}
+			}
+
+			// Block IO totals
+			if hasStats && metricEnabled("blkio") {
+				labels := d.labelsFor(container)
+
+				readBytes, writeBytes := sumBlkio(stats.BlkioStats.IoServiceBytesRecursive)
+				readOps, writeOps := sumBlkio(stats.BlkioStats.IoServicedRecursive)
+				if windowsStats(stats) {
+					readBytes, writeBytes = stats.StorageStats.ReadSizeBytes, stats.StorageStats.WriteSizeBytes
+					readOps, writeOps = stats.StorageStats.ReadCountNormalized, stats.StorageStats.WriteCountNormalized
+				}
+				blkioReadBytes.With(labels).Set(float64(readBytes))
+				blkioWriteBytes.With(labels).Set(float64(writeBytes))
+				blkioReadOps.With(labels).Set(float64(readOps))
+				blkioWriteOps.With(labels).Set(float64(writeOps))
+			}
 
-		// General data
-		{
-			labels := prometheus.Labels{
-				"container_name":  strings.TrimPrefix(container.Names[0], "/"),
-				"compose_project": container.Labels["com.docker.compose.project"],
-				"compose_service": container.Labels["com.docker.compose.service"],
+			// Container info
+			if metricEnabled("info") {
+				labels := d.labelsFor(container)
+				labels["container_id"] = container.ID
+				labels["container_image_id"] = strings.TrimPrefix(container.ImageID, "sha256:")
+				labels["container_image_name"] = container.Image
+				labels["container_image_digest"] = image.digest
+				labels["container_state"] = container.State
+				labels["container_state_running"] = strconv.FormatBool(inspect.State.Running)
+				labels["container_state_paused"] = strconv.FormatBool(inspect.State.Paused)
+				labels["container_state_restarting"] = strconv.FormatBool(inspect.State.Restarting)
+				labels["container_state_oomkilled"] = strconv.FormatBool(inspect.State.OOMKilled)
+				labels["container_state_dead"] = strconv.FormatBool(inspect.State.Dead)
+				labels["container_network_mode"] = ""
+				if inspect.HostConfig != nil {
+					labels["container_network_mode"] = string(inspect.HostConfig.NetworkMode)
+				}
+				labels["container_user"] = ""
+				if inspect.Config != nil {
+					labels["container_user"] = inspect.Config.User
+				}
+				for _, name := range allInfoLabels {
+					if !slices.Contains(infoLabels, name) {
+						delete(labels, name)
+					}
+				}
+				if infoCommand {
+					labels["container_command"] = containerCommand(inspect)
+				}
+				s, _ := json.Marshal(labels)
+				newKnownContainerInfos[container.ID+string(s)] = labels
+
+				containerInfo.With(labels).Set(1)
 			}
-			newKnownContainerIDs[container.ID] = labels
-
-			pids.With(labels).Set(float64(stats.PidsStats.Current))
-			cpuUsageUser.With(labels).Set(float64(stats.CPUStats.CPUUsage.UsageInUsermode) / 1e9)
-			cpuUsageKernel.With(labels).Set(float64(stats.CPUStats.CPUUsage.UsageInKernelmode) / 1e9)
-			cpuUsageTotal.With(labels).Set(float64(stats.CPUStats.CPUUsage.TotalUsage) / 1e9)
-			memoryUsage.With(labels).Set(float64(stats.MemoryStats.Usage - stats.MemoryStats.Stats["cache"]))
-			memoryLimit.With(labels).Set(float64(stats.MemoryStats.Limit))
-		}
-
-		// Networks
-		for intf, net := range stats.Networks {
-			labels := prometheus.Labels{
-				"container_name":  strings.TrimPrefix(container.Names[0], "/"),
-				"compose_project": container.Labels["com.docker.compose.project"],
-				"compose_service": container.Labels["com.docker.compose.service"],
-				"interface":       intf,
+
+			if !staleStats[container.ID] {
+				snapshot = append(snapshot, d.newContainerSnapshot(sample, total))
 			}
-			newKnownContainerNetworks[container.ID+intf] = labels
-
-			networkReceiveBytes.With(labels).Set(float64(net.RxBytes))
-			networkTransmitBytes.With(labels).Set(float64(net.TxBytes))
-			networkReceivePackets.With(labels).Set(float64(net.RxPackets))
-			networkTransmitPackets.With(labels).Set(float64(net.TxPackets))
-			networkReceiveErrors.With(labels).Set(float64(net.RxErrors))
-			networkTransmitErrors.With(labels).Set(float64(net.TxErrors))
-			networkReceiveDropped.With(labels).Set(float64(net.RxDropped))
-			networkTransmitDropped.With(labels).Set(float64(net.TxDropped))
-		}
-
-		// Disk IO
-		for _, stat := range stats.BlkioStats.IoServiceBytesRecursive {
-			labels := prometheus.Labels{
-				"container_name":  strings.TrimPrefix(container.Names[0], "/"),
-				"compose_project": container.Labels["com.docker.compose.project"],
-				"compose_service": container.Labels["com.docker.compose.service"],
-				"op":              stat.Op,
+		}()
+	}
+	d.snapshotMu.Lock()
+	for _, container := range d.snapshot {
+		if skipped[container.ID] || staleStats[container.ID] {
+			snapshot = append(snapshot, container)
+		}
+	}
+	d.snapshot = snapshot
+	d.snapshotMu.Unlock()
+	if len(staleStats) > 0 {
+		for _, known := range [][2]map[string]prometheus.Labels{
+			{d.knownContainerIDs, newKnownContainerIDs},
+			{d.knownContainerCPUs, newKnownContainerCPUs},
+			{d.knownContainerNetworks, newKnownContainerNetworks},
+			{d.knownContainerDiskStats, newKnownContainerDiskStats},
+		} {
+			keepSkipped(known[0], known[1], staleStats)
+		}
+	}
+	if len(skipped) > 0 {
+		// The series of containers left for later scrapes are kept until they are scraped again
+		for _, known := range [][2]map[string]prometheus.Labels{
+			{d.knownContainerIDs, newKnownContainerIDs},
+			{d.knownContainerStates, newKnownContainerStates},
+			{d.knownContainerHealths, newKnownContainerHealths},
+			{d.knownHealthStatuses, newKnownHealthStatuses},
+			{d.knownContainerCPUs, newKnownContainerCPUs},
+			{d.knownContainerNetworks, newKnownContainerNetworks},
+			{d.knownContainerDiskStats, newKnownContainerDiskStats},
+			{d.knownContainerInfos, newKnownContainerInfos},
+			{d.knownContainerMounts, newKnownContainerMounts},
+			{d.knownNetworkInfos, newKnownNetworkInfos},
+			{d.knownLogInfos, newKnownLogInfos},
+			{d.knownCapabilities, newKnownCapabilities},
+			{d.knownRestartPolicies, newKnownRestartPolicies},
+			{d.knownGPUs, newKnownGPUs},
+		} {
+			keepSkipped(known[0], known[1], skipped)
+		}
+		for id := range skipped {
+			if startedAt, ok := d.startTimes[id]; ok {
+				startTimes[id] = startedAt
 			}
-			newKnownContainerDiskStats[container.ID+"bytes"+stat.Op] = labels
-
-			diskIOBytes.With(labels).Set(float64(stat.Value))
-		}
-
-		// Container info
-		{
-			labels := prometheus.Labels{
-				"container_id":               container.ID,
-				"container_name":             strings.TrimPrefix(container.Names[0], "/"),
-				"compose_project":            container.Labels["com.docker.compose.project"],
-				"compose_service":            container.Labels["com.docker.compose.service"],
-				"container_image_id":         strings.TrimPrefix(container.ImageID, "sha256:"),
-				"container_image_name":       container.Image,
-				"container_state":            container.State,
-				"container_state_running":    strconv.FormatBool(inspect.State.Running),
-				"container_state_paused":     strconv.FormatBool(inspect.State.Paused),
-				"container_state_restarting": strconv.FormatBool(inspect.State.Restarting),
-				"container_state_oomkilled":  strconv.FormatBool(inspect.State.OOMKilled),
-				"container_state_dead":       strconv.FormatBool(inspect.State.Dead),
+			if seen, ok := d.lastSeenContainers[id]; ok {
+				seen.time = time.Now()
+				d.lastSeenContainers[id] = seen
 			}
-			s, _ := json.Marshal(labels)
-			newKnownContainerInfos[string(s)] = labels
+		}
+	}
 
-			containerInfo.With(labels).Set(1)
+	usedImages := make(map[string]bool, len(containers))
+	listedContainers := make(map[string]bool, len(containers))
+	for _, container := range containers {
+		usedImages[container.ImageID] = true
+		listedContainers[container.ID] = true
+	}
+	d.inspectCacheMu.Lock()
+	for id := range d.inspectCache {
+		if !listedContainers[id] {
+			delete(d.inspectCache, id)
 		}
 	}
+	d.inspectCacheMu.Unlock()
+	d.envMu.Lock()
+	for id := range d.env {
+		if !listedContainers[id] {
+			delete(d.env, id)
+		}
+	}
+	d.envMu.Unlock()
+	d.imageCacheMu.Lock()
+	for id := range d.imageCache {
+		if !usedImages[id] {
+			delete(d.imageCache, id)
+		}
+	}
+	d.imageCacheMu.Unlock()
 
-	for id, labels := range knownContainerIDs {
-		if newKnownContainerIDs[id] == nil {
-			pids.Delete(labels)
-			cpuUsageUser.Delete(labels)
-			cpuUsageKernel.Delete(labels)
-			cpuUsageTotal.Delete(labels)
-			memoryUsage.Delete(labels)
-			memoryLimit.Delete(labels)
+	pruneKnown(d.knownContainerIDs, newKnownContainerIDs, func(labels prometheus.Labels) {
+		pids.Delete(labels)
+		pidsLimit.Delete(labels)
+		cpuUsageUser.Delete(labels)
+		cpuUsageKernel.Delete(labels)
+		cpuUsageTotal.Delete(labels)
+		cpuOnline.Delete(labels)
+		cpuUsage.Delete(labels)
+		memoryUsage.Delete(labels)
+		memoryLimit.Delete(labels)
+		memoryWorking.Delete(labels)
+		memoryRSS.Delete(labels)
+		memoryCache.Delete(labels)
+		memorySwap.Delete(labels)
+		memoryMaxUsage.Delete(labels)
+		memoryFailcnt.Delete(labels)
+		memoryPercent.Delete(labels)
+		statsRead.Delete(labels)
+		blkioReadBytes.Delete(labels)
+		blkioWriteBytes.Delete(labels)
+		blkioReadOps.Delete(labels)
+		blkioWriteOps.Delete(labels)
+	})
+	pruneKnown(d.knownContainerStates, newKnownContainerStates, func(labels prometheus.Labels) {
+		for _, state := range containerStates {
+			stateLabels := prometheus.Labels{"state": state}
+			for k, v := range labels {
+				stateLabels[k] = v
+			}
+			currentState.Delete(stateLabels)
+		}
+		restartCount.Delete(labels)
+		createdTime.Delete(labels)
+		imageCreated.Delete(labels)
+		startedTime.Delete(labels)
+		exitCode.Delete(labels)
+		mountsCount.Delete(labels)
+		cpuLimit.Delete(labels)
+		memoryReserve.Delete(labels)
+		privileged.Delete(labels)
+		runsAsRoot.Delete(labels)
+		restartRetries.Delete(labels)
+		deviceCount.Delete(labels)
+		uptime.Delete(labels)
+		sizeRw.Delete(labels)
+		sizeRootFs.Delete(labels)
+	})
+	pruneKnown(d.knownContainerHealths, newKnownContainerHealths, func(labels prometheus.Labels) {
+		healthFailingStreak.Delete(labels)
+	})
+	pruneKnown(d.knownHealthStatuses, newKnownHealthStatuses, func(labels prometheus.Labels) {
+		healthStatus.Delete(labels)
+	})
+	// A recreated container has the same labels as the container it replaced, so expired series are
+	// deleted first and the most recently seen container wins for each set of labels
+	latestSeen := make(map[string]lastSeenContainer)
+	for id, seen := range d.lastSeenContainers {
+		if time.Since(seen.time) > lastSeenRetention {
+			lastSeen.Delete(seen.labels)
+			delete(d.lastSeenContainers, id)
+			continue
+		}
+		s, _ := json.Marshal(seen.labels)
+		if latest, ok := latestSeen[string(s)]; !ok || seen.time.After(latest.time) {
+			latestSeen[string(s)] = seen
 		}
 	}
-	for id, labels := range knownContainerNetworks {
-		if newKnownContainerNetworks[id] == nil {
-			networkReceiveBytes.Delete(labels)
-			networkTransmitBytes.Delete(labels)
-			networkReceivePackets.Delete(labels)
-			networkTransmitPackets.Delete(labels)
-			networkReceiveErrors.Delete(labels)
-			networkTransmitErrors.Delete(labels)
-			networkReceiveDropped.Delete(labels)
-			networkTransmitDropped.Delete(labels)
+	for _, seen := range latestSeen {
+		lastSeen.With(seen.labels).Set(float64(seen.time.UnixNano()) / 1e9)
+	}
+	d.pruneOOMEvents()
+	d.pruneRestartCounts()
+	pruneKnown(d.knownContainerCPUs, newKnownContainerCPUs, func(labels prometheus.Labels) {
+		cpuUsagePerCPU.Delete(labels)
+	})
+	pruneKnown(d.knownContainerNetworks, newKnownContainerNetworks, func(labels prometheus.Labels) {
+		networkReceiveBytes.Delete(labels)
+		networkTransmitBytes.Delete(labels)
+		networkReceivePackets.Delete(labels)
+		networkTransmitPackets.Delete(labels)
+		networkReceiveErrors.Delete(labels)
+		networkTransmitErrors.Delete(labels)
+		networkReceiveDropped.Delete(labels)
+		networkTransmitDropped.Delete(labels)
+	})
+	pruneKnown(d.knownContainerDiskStats, newKnownContainerDiskStats, func(labels prometheus.Labels) {
+		diskIOBytes.Delete(labels)
+	})
+	pruneKnown(d.knownContainerInfos, newKnownContainerInfos, func(labels prometheus.Labels) {
+		containerInfo.Delete(labels)
+	})
+	pruneKnown(d.knownContainerMounts, newKnownContainerMounts, func(labels prometheus.Labels) {
+		mountInfoVec.Delete(labels)
+	})
+	pruneKnown(d.knownNetworkInfos, newKnownNetworkInfos, func(labels prometheus.Labels) {
+		networkInfo.Delete(labels)
+	})
+	pruneKnown(d.knownLogInfos, newKnownLogInfos, func(labels prometheus.Labels) {
+		logInfo.Delete(labels)
+	})
+	pruneKnown(d.knownCapabilities, newKnownCapabilities, func(labels prometheus.Labels) {
+		capabilities.Delete(labels)
+	})
+	pruneKnown(d.knownRestartPolicies, newKnownRestartPolicies, func(labels prometheus.Labels) {
+		restartPolicy.Delete(labels)
+	})
+	pruneKnown(d.knownGPUs, newKnownGPUs, func(labels prometheus.Labels) {
+		gpuInfo.Delete(labels)
+	})
+	d.knownContainerIDs = newKnownContainerIDs
+	d.knownContainerStates = newKnownContainerStates
+	d.knownContainerHealths = newKnownContainerHealths
+	d.knownHealthStatuses = newKnownHealthStatuses
+	d.knownContainerCPUs = newKnownContainerCPUs
+	d.knownContainerNetworks = newKnownContainerNetworks
+	d.knownContainerDiskStats = newKnownContainerDiskStats
+	d.knownContainerInfos = newKnownContainerInfos
+	d.knownContainerMounts = newKnownContainerMounts
+	d.knownNetworkInfos = newKnownNetworkInfos
+	d.knownLogInfos = newKnownLogInfos
+	d.knownCapabilities = newKnownCapabilities
+	d.knownRestartPolicies = newKnownRestartPolicies
+	d.knownGPUs = newKnownGPUs
+
+	// The age histogram starts over every scrape, as it is of the containers running right now
+	containerAge.DeleteLabelValues(d.name)
+	age := containerAge.WithLabelValues(d.name)
+	for _, startedAt := range startTimes {
+		age.Observe(time.Since(startedAt).Seconds())
+	}
+	d.startTimes = startTimes
+	return err
+}
+
+// pruneKnown calls remove with the labels of the series in known that are not in current. Series
+// are tracked by container ID, but a recreated container can briefly have the same labels as the
+// one it replaces and a renamed one keeps its ID, so series are removed by their labels: those no
+// current series uses anymore.
+func pruneKnown(known, current map[string]prometheus.Labels, remove func(prometheus.Labels)) {
+	used := make(map[string]bool, len(current))
+	for _, labels := range current {
+		s, _ := json.Marshal(labels)
+		used[string(s)] = true
+	}
+	for _, labels := range known {
+		if s, _ := json.Marshal(labels); !used[string(s)] {
+			remove(labels)
 		}
 	}
-	for id, labels := range knownContainerDiskStats {
-		if newKnownContainerDiskStats[id] == nil {
-			diskIOBytes.Delete(labels)
+}
+
+// updateContainerCounts updates the number of all and running containers of the host, regardless of
+// the container filters. The listed containers are used if they include all containers, otherwise
+// all containers are listed separately.
+func (d *daemon) updateContainerCounts(ctx context.Context, containers []types.Container) {
+	if !all || len(listFilters) > 0 {
+		ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+		defer cancel()
+		var err error
+		containers, err = d.docker().ContainerList(ctx, types.ContainerListOptions{All: true})
+		if err != nil {
+			scrapeErrors.WithLabelValues(d.name, "list").Inc()
+			logThrottled(slog.LevelError, "Failed to get container list", err, "docker_host", d.name, "operation", "list")
+			return
 		}
 	}
-	for id, labels := range knownContainerInfos {
-		if newKnownContainerInfos[id] == nil {
-			containerInfo.Delete(labels)
+	running := 0
+	for _, container := range containers {
+		if container.State == "running" {
+			running++
 		}
 	}
-	knownContainerIDs = newKnownContainerIDs
-	knownContainerNetworks = newKnownContainerNetworks
-	knownContainerInfos = newKnownContainerInfos
+	containersTotal.WithLabelValues(d.name).Set(float64(len(containers)))
+	containersRunning.WithLabelValues(d.name).Set(float64(running))
+}
+
+// updateMemTotal gets the memory of the docker host, used to tell containers without a memory limit
+// apart. It is only fetched once, as it doesn't change while the daemon runs.
+func (d *daemon) updateMemTotal(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+	info, err := d.docker().Info(ctx)
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "info").Inc()
+		logThrottled(slog.LevelWarn, "Failed to get docker info", err, "docker_host", d.name, "operation", "info")
+		return
+	}
+	d.memTotal = info.MemTotal
+}
+
+func (d *daemon) updateDaemon(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, dockerTimeout)
+	defer cancel()
+	version, err := d.docker().ServerVersion(ctx)
+	if err != nil {
+		scrapeErrors.WithLabelValues(d.name, "version").Inc()
+		logThrottled(slog.LevelWarn, "Failed to get docker version", err, "docker_host", d.name, "operation", "version")
+		return
+	}
+
+	labels := prometheus.Labels{
+		"docker_host":    d.name,
+		"version":        version.Version,
+		"api_version":    version.APIVersion,
+		"os":             version.Os,
+		"arch":           version.Arch,
+		"kernel_version": version.KernelVersion,
+	}
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if d.knownDaemonInfo != nil {
+		daemonInfo.Delete(d.knownDaemonInfo)
+	}
+	daemonInfo.With(labels).Set(1)
+	d.knownDaemonInfo = labels
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. \040 for space) used in /proc/self/mounts.
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// dataMountPoints returns the mount points at or below basepath.
+func dataMountPoints(basepath string) ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	root := filepath.Clean(basepath)
+	var mountPoints []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		mountPoint := unescapeMountPath(fields[1])
+		if rel, err := filepath.Rel(root, mountPoint); err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		mountPoints = append(mountPoints, mountPoint)
+	}
+	return mountPoints, scanner.Err()
+}
+
+func updateData(basepath string) {
+	newKnownDataNames := make(map[string]prometheus.Labels)
+	filesystems := make(map[string]syscall.Statfs_t)
+	mountPoints, err := dataMountPoints(basepath)
+	if err != nil {
+		logThrottled(slog.LevelWarn, "Failed to get mount points", err, "basepath", basepath)
+	}
+	for _, mountPoint := range mountPoints {
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(mountPoint, &fs); err != nil {
+			logThrottled(slog.LevelWarn, "Failed to stat filesystem", err, "mount_point", mountPoint)
+			continue
+		}
+		if fs.Blocks == 0 {
+			// Pseudo filesystems such as proc and sysfs have no size
+			continue
+		}
+
+		rel, _ := filepath.Rel(basepath, mountPoint)
+		if rel == "." {
+			rel = ""
+		}
+		labels := prometheus.Labels{
+			"data_name": "/" + filepath.ToSlash(rel),
+		}
+		newKnownDataNames[labels["data_name"]] = labels
+		filesystems[labels["data_name"]] = fs
+	}
+
+	// The filesystems are statted first, so that the series are updated and pruned all at once
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for name, fs := range filesystems {
+		labels := newKnownDataNames[name]
+		dataFree.With(labels).Set(float64(fs.Bfree) * float64(fs.Bsize))
+		dataAvailable.With(labels).Set(float64(fs.Bavail) * float64(fs.Bsize))
+		dataSize.With(labels).Set(float64(fs.Blocks) * float64(fs.Bsize))
+		dataInodesFree.With(labels).Set(float64(fs.Ffree))
+		dataInodes.With(labels).Set(float64(fs.Files))
+	}
+	for name, labels := range knownDataNames {
+		if newKnownDataNames[name] == nil {
+			dataFree.Delete(labels)
+			dataAvailable.Delete(labels)
+			dataSize.Delete(labels)
+			dataInodesFree.Delete(labels)
+			dataInodes.Delete(labels)
+		}
+	}
+	knownDataNames = newKnownDataNames
+}
+
+// printOnce scrapes all daemons once and prints the metrics in the Prometheus text format. An error
+// is returned if listing the containers of a daemon failed, after printing whatever was gathered.
+func printOnce(ctx context.Context, daemons []*daemon) error {
+	var listErr error
+	for _, d := range daemons {
+		if err := d.updateContainers(ctx); err != nil {
+			listErr = fmt.Errorf("%s: %w", d.name, err)
+		}
+		d.updateDaemon(ctx)
+	}
+	if basepath != "" {
+		updateData(basepath)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		return err
+	}
+	encoder := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return err
+		}
+	}
+	return listErr
+}
+
+// basicAuth wraps the handler to require the given basic auth credentials. The credentials are
+// hashed before comparing them so the comparison takes constant time regardless of their length.
+func basicAuth(handler http.Handler, user, pass string) http.Handler {
+	userHash := sha256.Sum256([]byte(user))
+	passHash := sha256.Sum256([]byte(pass))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqUser, reqPass, ok := r.BasicAuth()
+		reqUserHash := sha256.Sum256([]byte(reqUser))
+		reqPassHash := sha256.Sum256([]byte(reqPass))
+		userOK := subtle.ConstantTimeCompare(reqUserHash[:], userHash[:]) == 1
+		passOK := subtle.ConstantTimeCompare(reqPassHash[:], passHash[:]) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="docker-stats", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
 }
 
 func main() {
-	docker, err := client.NewClientWithOpts(client.FromEnv)
+	parseFlags()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	daemons, err := newDaemons()
 	if err != nil {
-		panic(err)
+		fatal("Failed to create docker clients", "error", err)
+	}
+	if once {
+		defer closeDaemons(daemons)
+		setup()
+		if err := printOnce(ctx, daemons); err != nil {
+			fatal("Failed to scrape", "error", err)
+		}
+		return
 	}
+	// Replaced when the configuration is reloaded, the HTTP handlers always use the latest one
+	var current atomic.Pointer[exporter]
+	current.Store(startExporter(ctx, daemons))
 
-	setup()
+	// The flags are rewritten when the configuration is reloaded, so the handlers only use values
+	// captured here or kept by the current exporter
+	metricsPath := metricsPath
+	mux := http.NewServeMux()
+	var metricsHandler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		promhttp.HandlerFor(current.Load().gatherer(), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+	if authUser != "" {
+		metricsHandler = basicAuth(metricsHandler, authUser, authPass)
+	}
+	mux.Handle(metricsPath, metricsHandler)
+	if pprofEnabled {
+		pprofMux := http.NewServeMux()
+		pprofMux.HandleFunc("/debug/pprof/", pprof.Index)
+		pprofMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		pprofMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		pprofMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		pprofMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		var pprofHandler http.Handler = pprofMux
+		if authUser != "" {
+			pprofHandler = basicAuth(pprofHandler, authUser, authPass)
+		}
+		mux.Handle("/debug/pprof/", pprofHandler)
+	}
+	var snapshot http.Handler = snapshotHandler(func() []*daemon { return current.Load().daemons })
+	if authUser != "" {
+		snapshot = basicAuth(snapshot, authUser, authPass)
+	}
+	mux.Handle("/snapshot", snapshot)
+	var probe http.Handler = probeHandler(func() prometheus.Gatherer { return current.Load().gatherer() })
+	if authUser != "" {
+		probe = basicAuth(probe, authUser, authPass)
+	}
+	mux.Handle("/probe", probe)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		e := current.Load()
+		ctx, cancel := context.WithTimeout(r.Context(), e.dockerTimeout)
+		defer cancel()
+		var failed []string
+		for _, d := range e.daemons {
+			if _, err := d.docker().Ping(ctx); err != nil {
+				failed = append(failed, "Failed to ping docker: "+err.Error())
+			}
+		}
+		if len(failed) > 0 {
+			http.Error(w, strings.Join(failed, "\n"), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "OK")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, landingPage, html.EscapeString(metricsPath))
+	})
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		fatal("Failed to listen", "address", listen, "error", err)
+	}
+	server := &http.Server{Handler: mux}
+	if tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+		if err != nil {
+			fatal("Failed to load TLS certificate", "cert", tlsCert, "key", tlsKey, "error", err)
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
 	go func() {
-		for {
-			updateContainers(docker)
+		serve := server.Serve
+		if server.TLSConfig != nil {
+			serve = func(l net.Listener) error { return server.ServeTLS(l, "", "") }
+		}
+		if err := serve(listener); err != nil && err != http.ErrServerClosed {
+			fatal("Failed to serve HTTP", "error", err)
 		}
 	}()
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(":8080", nil)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-reload:
+			if configPath == "" {
+				slog.Warn("Ignoring SIGHUP without -config")
+				continue
+			}
+			current.Store(current.Load().reload(ctx))
+		}
+	}
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Failed to shut down HTTP server", "error", err)
+	}
+	current.Load().stop()
 }
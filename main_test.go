@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+)
+
+func TestMemoryStats(t *testing.T) {
+	tests := []struct {
+		name                          string
+		stats                         string
+		usage, rss, cache, workingSet uint64
+	}{
+		{
+			name:       "cgroup v1",
+			stats:      `{"usage":100000,"stats":{"cache":30000,"rss":60000,"total_inactive_file":20000}}`,
+			usage:      70000,
+			rss:        60000,
+			cache:      30000,
+			workingSet: 80000,
+		},
+		{
+			name:       "cgroup v2",
+			stats:      `{"usage":100000,"stats":{"inactive_file":25000,"anon":50000,"file":40000}}`,
+			usage:      75000,
+			rss:        50000,
+			cache:      40000,
+			workingSet: 75000,
+		},
+		{
+			name:       "cache above usage",
+			stats:      `{"usage":10000,"stats":{"inactive_file":25000,"anon":5000,"file":40000}}`,
+			usage:      10000,
+			rss:        5000,
+			cache:      40000,
+			workingSet: 0,
+		},
+		{
+			name:       "windows",
+			stats:      `{"privateworkingset":42000}`,
+			usage:      42000,
+			workingSet: 42000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stats types.MemoryStats
+			if err := json.Unmarshal([]byte(test.stats), &stats); err != nil {
+				t.Fatal(err)
+			}
+			if got := memoryUsageBytes(stats); got != test.usage {
+				t.Errorf("memoryUsageBytes = %d, want %d", got, test.usage)
+			}
+			if got := memoryStat(stats, "rss", "anon"); got != test.rss {
+				t.Errorf("rss = %d, want %d", got, test.rss)
+			}
+			if got := memoryStat(stats, "cache", "file"); got != test.cache {
+				t.Errorf("cache = %d, want %d", got, test.cache)
+			}
+			if got := memoryWorkingSet(stats); got != test.workingSet {
+				t.Errorf("memoryWorkingSet = %d, want %d", got, test.workingSet)
+			}
+		})
+	}
+}
+
+func TestMissingStats(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(2e9, 2e9))
+	docker.add("b", "new", "running", nil)
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+
+	// A container that never had stats has zeros for the gauges but no counters
+	if got := gather(t, "container_pids", "container_name"); got["new"] != 0 || len(got) != 2 {
+		t.Errorf("container_pids = %v, want web and new", got)
+	}
+	for _, name := range []string{"container_cpu_usage_seconds_total", "container_cpu_usage_user_seconds_total", "container_memory_failcnt_total"} {
+		if got := gather(t, name, "container_name"); len(got) != 1 || got["web"] == 0 {
+			t.Errorf("%s = %v, want only web", name, got)
+		}
+	}
+
+	// Stats failing for a known container keep the previous values
+	delete(docker.stats, "a")
+	scrape(t, d)
+	if got := gather(t, "container_cpu_usage_seconds_total", "container_name"); got["web"] != 4 {
+		t.Errorf("container_cpu_usage_seconds_total = %v, want web kept at 4", got)
+	}
+	if got := gather(t, "container_memory_failcnt_total", "container_name"); got["web"] != 3 {
+		t.Errorf("container_memory_failcnt_total = %v, want web kept at 3", got)
+	}
+	if got := gather(t, "container_cpu_usage_percpu_seconds_total", "cpu"); len(got) != 2 {
+		t.Errorf("container_cpu_usage_percpu_seconds_total = %v, want 2 CPUs kept", got)
+	}
+	if got := gather(t, "container_stats_read_timestamp_seconds", "container_name"); got["web"] == 0 {
+		t.Errorf("container_stats_read_timestamp_seconds = %v, want web kept", got)
+	}
+}
+
+func TestRecreatedContainer(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9, 1e9))
+	docker.add("b", "web", "running", fakeStats(2e9, 2e9))
+	d := newTestDaemon(t, docker)
+	metrics := []string{
+		"container_cpu_usage_seconds_total",
+		"container_cpu_usage_percpu_seconds_total",
+		"container_memory_usage_bytes",
+		"container_state",
+		"container_info",
+		"container_last_seen_timestamp_seconds",
+	}
+	check := func(step string) {
+		t.Helper()
+		for _, name := range metrics {
+			if got := gather(t, name, "container_name"); len(got) != 1 || !hasKey(got, "web") {
+				t.Errorf("%s: %s = %v, want web", step, name, got)
+			}
+		}
+	}
+
+	docker.set("a")
+	scrape(t, d)
+	check("old container")
+
+	docker.set("a", "b")
+	scrape(t, d)
+	check("old and new container")
+
+	docker.set("b")
+	scrape(t, d)
+	check("new container")
+	if got := gather(t, "container_cpu_usage_seconds_total", "container_name"); got["web"] != 4 {
+		t.Errorf("container_cpu_usage_seconds_total = %v, want web of the new container", got)
+	}
+
+	docker.rename("b", "web2")
+	scrape(t, d)
+	for _, name := range metrics[:len(metrics)-1] {
+		if got := gather(t, name, "container_name"); len(got) != 1 || !hasKey(got, "web2") {
+			t.Errorf("renamed container: %s = %v, want web2", name, got)
+		}
+	}
+
+	docker.set()
+	scrape(t, d)
+	if got := gather(t, "container_cpu_usage_seconds_total", "container_name"); len(got) != 0 {
+		t.Errorf("container_cpu_usage_seconds_total = %v after the container is gone, want none", got)
+	}
+}
+
+func TestRenamedContainer(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9))
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+	docker.rename("a", "web2")
+	scrape(t, d)
+
+	if got := gather(t, "container_last_seen_timestamp_seconds", "container_name"); len(got) != 1 || !hasKey(got, "web2") {
+		t.Errorf("container_last_seen_timestamp_seconds = %v, want web2", got)
+	}
+}
+
+func TestRestartCounts(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9))
+	docker.add("b", "db", "running", fakeStats(1e9))
+	docker.restart("a", 2)
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+	if got := gather(t, "container_restart_count_total", "container_name"); got["web"] != 2 || got["db"] != 0 {
+		t.Errorf("container_restart_count_total = %v, want web at 2 and db at 0", got)
+	}
+
+	docker.rename("a", "web2")
+	scrape(t, d)
+	if got := gather(t, "container_restart_count_total", "container_name"); len(got) != 2 || got["web2"] != 2 {
+		t.Errorf("container_restart_count_total = %v after renaming, want web2 at 2 and db", got)
+	}
+
+	// Containers are forgotten once they have not been seen for lastSeenRetention
+	docker.set()
+	for id, seen := range d.lastSeenContainers {
+		seen.time = seen.time.Add(-2 * lastSeenRetention)
+		d.lastSeenContainers[id] = seen
+	}
+	scrape(t, d)
+	if got := gather(t, "container_restart_count_total", "container_name"); len(got) != 0 {
+		t.Errorf("container_restart_count_total = %v after the containers are gone, want none", got)
+	}
+	if len(d.restartCounts) != 1 {
+		t.Errorf("restart counts of %d label sets are kept, want only those of web2 with restarts", len(d.restartCounts))
+	}
+}
+
+func TestOOMEvents(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9))
+	docker.add("b", "db", "running", fakeStats(1e9))
+	docker.set("a")
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+
+	for _, id := range []string{"a", "a", "b"} {
+		d.handleOOMEvent(events.Message{Action: "oom", Actor: events.Actor{ID: id, Attributes: map[string]string{"name": "db"}}})
+	}
+	if got := gather(t, "container_oom_events_total", "container_name"); len(got) != 1 || got["web"] != 2 {
+		t.Errorf("container_oom_events_total = %v, want web at 2 and none for the unlisted db", got)
+	}
+}
+
+func TestInspectCache(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9))
+	d := newTestDaemon(t, docker)
+	withFlag(t, &inspectCacheTTL, time.Minute)
+	scrape(t, d)
+
+	// The container restarts between two scrapes, running in both
+	docker.restart("a", 1)
+	scrape(t, d)
+	if got := gather(t, "container_restart_count", "container_name"); got["web"] != 0 {
+		t.Errorf("container_restart_count = %v, want the cached web at 0", got)
+	}
+	for _, action := range []string{"die", "start"} {
+		d.handleEvent(events.Message{Action: action, Actor: events.Actor{ID: "a"}}, make(chan struct{}, 1))
+	}
+	scrape(t, d)
+	if got := gather(t, "container_restart_count", "container_name"); got["web"] != 1 {
+		t.Errorf("container_restart_count = %v after the start event, want web at 1", got)
+	}
+}
+
+func hasKey(s series, key string) bool {
+	_, ok := s[key]
+	return ok
+}
+
+func TestPerCPUUsage(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9, 1e9, 1e9, 1e9))
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+	if got := gather(t, "container_cpu_usage_percpu_seconds_total", "cpu"); len(got) != 4 {
+		t.Errorf("container_cpu_usage_percpu_seconds_total = %v, want 4 CPUs", got)
+	}
+
+	// cgroup v1 keeps reporting CPUs that are no longer online
+	stats := fakeStats(1e9, 1e9, 1e9, 1e9)
+	stats.CPUStats.OnlineCPUs = 2
+	docker.stats["a"] = *stats
+	scrape(t, d)
+	got := gather(t, "container_cpu_usage_percpu_seconds_total", "cpu")
+	if len(got) != 2 || !hasKey(got, "0") || !hasKey(got, "1") {
+		t.Errorf("container_cpu_usage_percpu_seconds_total = %v, want CPUs 0 and 1", got)
+	}
+
+	withFlag(t, &maxPerCPU, 1)
+	scrape(t, d)
+	if got := gather(t, "container_cpu_usage_percpu_seconds_total", "cpu"); len(got) != 0 {
+		t.Errorf("container_cpu_usage_percpu_seconds_total = %v with -max-percpu 1, want none", got)
+	}
+	if got := gather(t, "container_cpu_usage_seconds_total", "container_name"); got["web"] != 4 {
+		t.Errorf("container_cpu_usage_seconds_total = %v with -max-percpu 1, want web at 4", got)
+	}
+
+	withFlag(t, &maxPerCPU, 2)
+	scrape(t, d)
+	if got := gather(t, "container_cpu_usage_percpu_seconds_total", "cpu"); len(got) != 2 {
+		t.Errorf("container_cpu_usage_percpu_seconds_total = %v with -max-percpu 2, want 2 CPUs", got)
+	}
+}
+
+func TestStoppedContainer(t *testing.T) {
+	withFlag(t, &all, true)
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(1e9, 1e9))
+	docker.add("b", "db", "exited", nil)
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+
+	if calls := docker.calls("b"); calls != 0 {
+		t.Errorf("stats of the exited container fetched %d times, want never", calls)
+	}
+	for _, name := range []string{"container_info", "container_state", "container_exit_code"} {
+		if got := gather(t, name, "container_name"); !hasKey(got, "db") {
+			t.Errorf("%s = %v, want db", name, got)
+		}
+	}
+	for _, name := range []string{"container_cpu_usage_seconds_total", "container_cpu_usage_percent", "container_cpu_online_count", "container_memory_usage_bytes"} {
+		if got := gather(t, name, "container_name"); hasKey(got, "db") || !hasKey(got, "web") {
+			t.Errorf("%s = %v, want only web", name, got)
+		}
+	}
+	// The state of the exited container is exited, and 0 for the other states
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != "container_state" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := make(map[string]string)
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["container_name"] != "db" {
+				continue
+			}
+			if want := labels["state"] == "exited"; (metric.GetGauge().GetValue() == 1) != want {
+				t.Errorf("container_state of db in state %s = %v", labels["state"], metric.GetGauge().GetValue())
+			}
+		}
+	}
+}
+
+func BenchmarkUpdateContainers(b *testing.B) {
+	docker := newFakeDocker()
+	for i := 0; i < 500; i++ {
+		stats := fakeStats(1e9, 1e9)
+		stats.Networks = map[string]types.NetworkStats{"eth0": {RxBytes: 100, TxBytes: 200}}
+		docker.add(fmt.Sprintf("%064d", i), fmt.Sprintf("web-%d", i), "running", stats)
+	}
+	d := newTestDaemon(b, docker)
+	scrape(b, d)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		scrape(b, d)
+	}
+}
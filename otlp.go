@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// How long sending the metrics of a push to the OTLP endpoint may take
+const otlpTimeout = 10 * time.Second
+
+// The OTLP metrics request in the JSON encoding of OTLP/HTTP, with only the fields the exporter uses.
+// 64 bit integers are encoded as strings, as the protobuf JSON mapping requires.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality int                   `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value otlpAttrString `json:"value"`
+	}
+	otlpAttrString struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// Cumulative aggregation temporality, as the counters kept by docker and the exporter are
+const otlpCumulative = 2
+
+// Histograms that start over every scrape, as they are of the containers right now rather than
+// cumulative. They are sent as gauges of their buckets, count and sum, like in the Prometheus format.
+var otlpSnapshotHistograms = map[string]bool{
+	dockerPrefix + "container_age_seconds": true,
+}
+
+// pushOTLP sends the metrics of the registry to the OTLP/HTTP endpoint every interval until the
+// context is done. The sums and histograms are cumulative since start, when the exporter started.
+func pushOTLP(ctx context.Context, endpoint string, gatherer prometheus.Gatherer, start time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := sendOTLP(ctx, endpoint, gatherer, start, time.Now()); err != nil {
+			logThrottled(slog.LevelError, "Failed to push metrics to OTLP endpoint", err, "endpoint", endpoint)
+		}
+	}
+}
+
+// otlpMetricsURL returns the URL to send metrics to for an OTLP/HTTP endpoint, which is the base URL
+// of the collector unless it already has the metrics path.
+func otlpMetricsURL(endpoint string) string {
+	if strings.HasSuffix(endpoint, "/v1/metrics") {
+		return endpoint
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/metrics"
+}
+
+// sendOTLP sends the metrics of the registry to the OTLP/HTTP endpoint in the JSON encoding.
+func sendOTLP(ctx context.Context, endpoint string, gatherer prometheus.Gatherer, start, now time.Time) error {
+	request, err := otlpMetrics(gatherer, start, now)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, otlpTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, otlpMetricsURL(endpoint), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// otlpMetrics converts the metrics of the registry to an OTLP request. Gauges map to OTLP gauges,
+// counters to monotonic cumulative sums and histograms to cumulative histograms, with the labels as
+// attributes. Labels with empty values are left out, as Prometheus treats them as missing. The sums
+// and histograms have start as their start time, so that collectors can tell when they start over.
+func otlpMetrics(gatherer prometheus.Gatherer, start, now time.Time) (otlpRequest, error) {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return otlpRequest{}, err
+	}
+	startTimestamp := strconv.FormatInt(start.UnixNano(), 10)
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+	var metrics []otlpMetric
+	for _, family := range families {
+		if otlpSnapshotHistograms[family.GetName()] {
+			metrics = append(metrics, otlpGaugeHistogram(family, timestamp)...)
+			continue
+		}
+		metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+		for _, m := range family.GetMetric() {
+			attributes := otlpAttributes(m)
+			point := func(value float64) otlpNumberDataPoint {
+				return otlpNumberDataPoint{Attributes: attributes, TimeUnixNano: timestamp, AsDouble: value}
+			}
+			switch {
+			case m.Gauge != nil || m.Untyped != nil:
+				value := m.GetGauge().GetValue()
+				if m.Untyped != nil {
+					value = m.Untyped.GetValue()
+				}
+				if math.IsNaN(value) || math.IsInf(value, 0) {
+					continue
+				}
+				if metric.Gauge == nil {
+					metric.Gauge = &otlpGauge{}
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, point(value))
+			case m.Counter != nil:
+				if metric.Sum == nil {
+					metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+				}
+				p := point(m.Counter.GetValue())
+				p.StartTimeUnixNano = startTimestamp
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, p)
+			case m.Histogram != nil:
+				// Prometheus buckets are cumulative, OTLP buckets count the samples in each bucket
+				// and have an extra bucket for the samples above the last bound
+				h := otlpHistogramDataPoint{
+					Attributes:        attributes,
+					StartTimeUnixNano: startTimestamp,
+					TimeUnixNano:      timestamp,
+					Count:             strconv.FormatUint(m.Histogram.GetSampleCount(), 10),
+					Sum:               m.Histogram.GetSampleSum(),
+				}
+				var previous uint64
+				for _, bucket := range m.Histogram.GetBucket() {
+					if math.IsInf(bucket.GetUpperBound(), 1) {
+						continue
+					}
+					h.ExplicitBounds = append(h.ExplicitBounds, bucket.GetUpperBound())
+					h.BucketCounts = append(h.BucketCounts, strconv.FormatUint(bucket.GetCumulativeCount()-previous, 10))
+					previous = bucket.GetCumulativeCount()
+				}
+				h.BucketCounts = append(h.BucketCounts, strconv.FormatUint(m.Histogram.GetSampleCount()-previous, 10))
+				if metric.Histogram == nil {
+					metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+				}
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, h)
+			}
+		}
+		if metric.Gauge != nil || metric.Sum != nil || metric.Histogram != nil {
+			metrics = append(metrics, metric)
+		}
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAttrString{"docker-stats"}},
+			{Key: "service.version", Value: otlpAttrString{version}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/Scrin/docker-stats", Version: version},
+			Metrics: metrics,
+		}},
+	}}}, nil
+}
+
+// otlpAttributes returns the labels of a metric as attributes, leaving out those with empty values.
+func otlpAttributes(m *dto.Metric) []otlpAttribute {
+	var attributes []otlpAttribute
+	for _, label := range m.GetLabel() {
+		if label.GetValue() != "" {
+			attributes = append(attributes, otlpAttribute{Key: label.GetName(), Value: otlpAttrString{label.GetValue()}})
+		}
+	}
+	return attributes
+}
+
+// otlpGaugeHistogram converts a histogram that starts over every scrape to gauges of its cumulative
+// buckets, with the bound as the le attribute, and of its sample count and sum.
+func otlpGaugeHistogram(family *dto.MetricFamily, timestamp string) []otlpMetric {
+	buckets := otlpMetric{Name: family.GetName() + "_bucket", Description: family.GetHelp(), Gauge: &otlpGauge{}}
+	count := otlpMetric{Name: family.GetName() + "_count", Description: family.GetHelp(), Gauge: &otlpGauge{}}
+	sum := otlpMetric{Name: family.GetName() + "_sum", Description: family.GetHelp(), Gauge: &otlpGauge{}}
+	for _, m := range family.GetMetric() {
+		if m.Histogram == nil {
+			continue
+		}
+		attributes := otlpAttributes(m)
+		for _, bucket := range m.Histogram.GetBucket() {
+			le := otlpAttribute{Key: "le", Value: otlpAttrString{strconv.FormatFloat(bucket.GetUpperBound(), 'g', -1, 64)}}
+			buckets.Gauge.DataPoints = append(buckets.Gauge.DataPoints, otlpNumberDataPoint{
+				Attributes:   append(attributes[:len(attributes):len(attributes)], le),
+				TimeUnixNano: timestamp,
+				AsDouble:     float64(bucket.GetCumulativeCount()),
+			})
+		}
+		count.Gauge.DataPoints = append(count.Gauge.DataPoints, otlpNumberDataPoint{
+			Attributes: attributes, TimeUnixNano: timestamp, AsDouble: float64(m.Histogram.GetSampleCount()),
+		})
+		sum.Gauge.DataPoints = append(sum.Gauge.DataPoints, otlpNumberDataPoint{
+			Attributes: attributes, TimeUnixNano: timestamp, AsDouble: m.Histogram.GetSampleSum(),
+		})
+	}
+	if len(count.Gauge.DataPoints) == 0 {
+		return nil
+	}
+	return []otlpMetric{buckets, count, sum}
+}
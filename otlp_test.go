@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestOTLPMetrics(t *testing.T) {
+	docker := newFakeDocker()
+	docker.add("a", "web", "running", fakeStats(2e9, 2e9))
+	d := newTestDaemon(t, docker)
+	scrape(t, d)
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "test_duration_seconds", Help: "Test"})
+	histogram.Observe(1)
+	other := prometheus.NewRegistry()
+	other.MustRegister(histogram)
+
+	start, now := time.Unix(1700000000, 0), time.Unix(1700000060, 0)
+	request, err := otlpMetrics(prometheus.Gatherers{registry, other}, start, now)
+	if err != nil {
+		t.Fatalf("converting metrics failed: %v", err)
+	}
+	metrics := make(map[string]otlpMetric)
+	for _, metric := range request.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		metrics[metric.Name] = metric
+	}
+
+	cpu := metrics["container_cpu_usage_seconds_total"]
+	if cpu.Sum == nil || cpu.Sum.AggregationTemporality != otlpCumulative || len(cpu.Sum.DataPoints) != 1 {
+		t.Fatalf("container_cpu_usage_seconds_total = %+v, want a cumulative sum with one point", cpu)
+	}
+	if got := cpu.Sum.DataPoints[0].StartTimeUnixNano; got != "1700000000000000000" {
+		t.Errorf("start time = %q, want the start of the exporter", got)
+	}
+	duration := metrics["test_duration_seconds"]
+	if duration.Histogram == nil || duration.Histogram.AggregationTemporality != otlpCumulative || len(duration.Histogram.DataPoints) != 1 {
+		t.Fatalf("test_duration_seconds = %+v, want a cumulative histogram with one point", duration)
+	}
+	if got := duration.Histogram.DataPoints[0].StartTimeUnixNano; got != "1700000000000000000" {
+		t.Errorf("histogram start time = %q, want the start of the exporter", got)
+	}
+
+	if _, ok := metrics["docker_container_age_seconds"]; ok {
+		t.Error("docker_container_age_seconds is sent as a cumulative histogram")
+	}
+	count := metrics["docker_container_age_seconds_count"]
+	if count.Gauge == nil || len(count.Gauge.DataPoints) != 1 || count.Gauge.DataPoints[0].AsDouble != 1 {
+		t.Errorf("docker_container_age_seconds_count = %+v, want a gauge of one container", count)
+	}
+	buckets := metrics["docker_container_age_seconds_bucket"]
+	if buckets.Gauge == nil || len(buckets.Gauge.DataPoints) != 7 {
+		t.Errorf("docker_container_age_seconds_bucket = %+v, want a gauge per bucket", buckets)
+	}
+}
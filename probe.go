@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// containerGatherer gathers only the series of a single container, by its container_name and
+// optionally docker_host labels.
+type containerGatherer struct {
+	gatherer   prometheus.Gatherer
+	name, host string
+}
+
+func (g containerGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	var result []*dto.MetricFamily
+	for _, family := range families {
+		var metrics []*dto.Metric
+		for _, metric := range family.GetMetric() {
+			if g.matches(metric) {
+				metrics = append(metrics, metric)
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			result = append(result, family)
+		}
+	}
+	return result, err
+}
+
+func (g containerGatherer) matches(metric *dto.Metric) bool {
+	name, host := false, g.host == ""
+	for _, label := range metric.GetLabel() {
+		switch label.GetName() {
+		case "container_name":
+			name = label.GetValue() == g.name
+		case "docker_host":
+			host = host || label.GetValue() == g.host
+		}
+	}
+	return name && host
+}
+
+// probeHandler serves the metrics of the container given in the container query parameter, and the
+// docker_host parameter with several docker hosts, following the multi-target exporter pattern.
+// probe_success is 0 when there are no metrics for the container.
+func probeHandler(gatherer func() prometheus.Gatherer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("container")
+		if name == "" {
+			http.Error(w, "container parameter is missing", http.StatusBadRequest)
+			return
+		}
+		container := containerGatherer{gatherer: gatherer(), name: name, host: r.URL.Query().Get("docker_host")}
+		families, err := container.Gather()
+
+		probeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "probe_success",
+			Help: "Whether the container has metrics, 1 or 0",
+		})
+		if len(families) > 0 {
+			probeSuccess.Set(1)
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(probeSuccess)
+		gatherers := prometheus.Gatherers{registry, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, err
+		})}
+		promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
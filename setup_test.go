@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// containerCollectors returns the container metrics by their -metrics group.
+func containerCollectors() map[string][]prometheus.Collector {
+	return map[string][]prometheus.Collector{
+		"pids":       {pids, pidsLimit},
+		"cpu":        {cpuUsageUser, cpuUsageKernel, cpuUsageTotal, cpuUsagePerCPU, cpuOnline, cpuUsage, cpuLimit},
+		"memory":     {memoryUsage, memoryLimit, memoryReserve, memoryWorking, memoryRSS, memoryCache, memorySwap, memoryMaxUsage, memoryFailcnt, memoryPercent, oomEvents},
+		"state":      {currentState, createdTime, imageCreated, startedTime, exitCode, uptime, sizeRw, sizeRootFs, lastSeen, statsRead},
+		"restart":    {restartCount, restartTotal, restartPolicy, restartRetries},
+		"mounts":     {mountsCount, mountInfoVec},
+		"log":        {logInfo},
+		"privileges": {privileged, runsAsRoot, capabilities},
+		"devices":    {deviceCount, gpuInfo},
+		"health":     {healthStatus, healthFailingStreak},
+		"network": {networkInfo, networkReceiveBytes, networkTransmitBytes, networkReceivePackets, networkTransmitPackets,
+			networkReceiveErrors, networkTransmitErrors, networkReceiveDropped, networkTransmitDropped},
+		"blkio": {diskIOBytes, blkioReadBytes, blkioWriteBytes, blkioReadOps, blkioWriteOps},
+		"info":  {containerInfo},
+	}
+}
+
+// otherCollectors returns the metrics that are always registered.
+func otherCollectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		dataFree, dataAvailable, dataSize, dataInodesFree, dataInodes,
+		scrapeErrors, scrapeDuration, lastScrapeTimestamp, clockSkew, scrapesTotal, buildInfo,
+		daemonInfo, containersTotal, containersRunning, containerAge,
+	}
+}
+
+// registered returns whether a collector is registered in the registry.
+func registered(t *testing.T, collector prometheus.Collector) bool {
+	t.Helper()
+	err := registry.Register(collector)
+	if err == nil {
+		registry.Unregister(collector)
+		return false
+	}
+	var already prometheus.AlreadyRegisteredError
+	if !errors.As(err, &already) {
+		t.Fatalf("registering %v failed: %v", collector, err)
+	}
+	return true
+}
+
+// Setup panics when a collector is registered twice, so these also check that every collector is
+// registered only once.
+func TestSetup(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		setup()
+		for group, collectors := range containerCollectors() {
+			for _, collector := range collectors {
+				if want := collector != mountInfoVec; registered(t, collector) != want {
+					t.Errorf("collector of group %s registered = %v, want %v", group, !want, want)
+				}
+			}
+		}
+		for _, collector := range otherCollectors() {
+			if !registered(t, collector) {
+				t.Errorf("collector %v not registered", collector)
+			}
+		}
+	})
+	t.Run("everything", func(t *testing.T) {
+		withFlag(t, &metricGroups, append(stringList{}, allMetricGroups...))
+		withFlag(t, &mountInfo, true)
+		withFlag(t, &logPath, true)
+		withFlag(t, &infoCommand, true)
+		withFlag(t, &listSize, true)
+		withFlag(t, &goMetrics, true)
+		setup()
+		for group, collectors := range containerCollectors() {
+			for _, collector := range collectors {
+				if !registered(t, collector) {
+					t.Errorf("collector of group %s not registered", group)
+				}
+			}
+		}
+		for _, collector := range otherCollectors() {
+			if !registered(t, collector) {
+				t.Errorf("collector %v not registered", collector)
+			}
+		}
+	})
+	t.Run("groups", func(t *testing.T) {
+		withFlag(t, &metricGroups, stringList{"cpu", "state"})
+		setup()
+		for group, collectors := range containerCollectors() {
+			for _, collector := range collectors {
+				want := (group == "cpu" || group == "state") && collector != mountInfoVec
+				if registered(t, collector) != want {
+					t.Errorf("collector of group %s registered = %v, want %v", group, !want, want)
+				}
+			}
+		}
+	})
+}
+
+func TestContainerCollectorGroups(t *testing.T) {
+	setup()
+	groups := containerCollectors()
+	for _, group := range allMetricGroups {
+		if len(groups[group]) == 0 {
+			t.Errorf("group %s has no collectors", group)
+		}
+	}
+	if len(groups) != len(allMetricGroups) {
+		t.Errorf("%d groups, want %d", len(groups), len(allMetricGroups))
+	}
+}
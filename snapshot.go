@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/docker/docker/api/types"
+)
+
+// containerSnapshot is a container as of the last scrape, as served on /snapshot.
+type containerSnapshot struct {
+	DockerHost           string  `json:"docker_host"`
+	ID                   string  `json:"id"`
+	Name                 string  `json:"name"`
+	ComposeProject       string  `json:"compose_project"`
+	ComposeService       string  `json:"compose_service"`
+	Image                string  `json:"image"`
+	State                string  `json:"state"`
+	CPUPercent           float64 `json:"cpu_percent"`
+	CPUSeconds           float64 `json:"cpu_seconds_total"`
+	MemoryUsageBytes     uint64  `json:"memory_usage_bytes"`
+	MemoryLimitBytes     uint64  `json:"memory_limit_bytes"`
+	NetworkReceiveBytes  uint64  `json:"network_receive_bytes_total"`
+	NetworkTransmitBytes uint64  `json:"network_transmit_bytes_total"`
+}
+
+// newContainerSnapshot returns the snapshot of a scraped container, with the network totals summed
+// over its exported interfaces.
+func (d *daemon) newContainerSnapshot(sample *containerSample, network types.NetworkStats) containerSnapshot {
+	labels := d.labelsFor(sample.container)
+	return containerSnapshot{
+		DockerHost:           d.name,
+		ID:                   sample.container.ID,
+		Name:                 labels["container_name"],
+		ComposeProject:       labels["compose_project"],
+		ComposeService:       labels["compose_service"],
+		Image:                sample.container.Image,
+		State:                sample.container.State,
+		CPUPercent:           cpuPercent(sample.stats),
+		CPUSeconds:           cpuSeconds(sample.stats, sample.stats.CPUStats.CPUUsage.TotalUsage),
+		MemoryUsageBytes:     memoryUsageBytes(sample.stats.MemoryStats),
+		MemoryLimitBytes:     d.memoryLimit(sample.stats.MemoryStats),
+		NetworkReceiveBytes:  network.RxBytes,
+		NetworkTransmitBytes: network.TxBytes,
+	}
+}
+
+// snapshotHandler serves the containers of the daemons as of their last scrape as a JSON array.
+func snapshotHandler(daemons func() []*daemon) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		containers := []containerSnapshot{}
+		for _, d := range daemons() {
+			d.snapshotMu.Lock()
+			containers = append(containers, d.snapshot...)
+			d.snapshotMu.Unlock()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(containers); err != nil {
+			slog.Debug("Failed to write snapshot", "error", err)
+		}
+	})
+}